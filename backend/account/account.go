@@ -0,0 +1,107 @@
+package account
+
+import (
+	"net/http"
+	"strings"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/blog"
+	"blogr.moe/backend/logs"
+	"blogr.moe/backend/utils/queue"
+	"github.com/labstack/echo/v4"
+)
+
+// Deletions and exports are slow, so they run in the background one at a time.
+var (
+	manager      = queue.NewQueueManager()
+	deletionJobs = manager.GetQueue("deletions", 100)
+	exportJobs   = manager.GetQueue("exports", 100)
+)
+
+func init() {
+	manager.ProcessAll()
+}
+
+// QueueStats reports the backlog of the deletion and export queues.
+func QueueStats() []queue.QueueStats {
+	return manager.Stats()
+}
+
+type UsernameRequest struct {
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+}
+
+// ChangeUsername renames the logged in user. Their posts and comments move to
+// the new name and links to the old /u/ URLs redirect to it.
+func ChangeUsername(c echo.Context) error {
+	var req UsernameRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	user, status, msg := auth.Reauthenticate(c, req.Password)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	username := strings.TrimSpace(req.Username)
+	if !auth.ValidUsername(username) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Usernames are 3 to 32 letters, numbers, - or _"})
+	}
+	if username == user.Username {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "That is already your username"})
+	}
+	ctx := c.Request().Context()
+
+	taken, err := auth.UsernameTaken(ctx, username, user.UUID)
+	if err != nil {
+		logs.Error("Error checking username:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if taken {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "That username is taken"})
+	}
+
+	// posts move first, so a failure leaves the account on its old name with
+	// the posts moved back to it
+	err = blog.RenameAuthor(ctx, user.UUID, user.Username, username)
+	if err == nil {
+		err = auth.SetUsername(ctx, user, username)
+	}
+	if err != nil {
+		logs.Error("Error renaming", user.UUID, err)
+		if err := blog.RenameAuthor(ctx, user.UUID, username, user.Username); err != nil {
+			logs.Error("Error moving posts of", user.UUID, "back to", user.Username, err)
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	logs.Info("User", user.Username, "renamed to", username)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Username updated", "username": username})
+}
+
+// RedirectRenamed sends requests for a username that has been changed to the
+// same path under the new name. It wraps routes with a :user parameter.
+func RedirectRenamed(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("user")
+		if _, err := auth.GetUserByUsername(name); err == nil {
+			return next(c)
+		}
+		user, err := auth.RenamedUser(c.Request().Context(), name)
+		if err != nil {
+			return next(c)
+		}
+
+		// paths look like /u/<name>/... or /i/<name>/...
+		parts := strings.SplitN(c.Request().URL.Path, "/", 4)
+		if len(parts) < 3 || parts[2] != name {
+			return next(c)
+		}
+		parts[2] = user.Username
+		target := strings.Join(parts, "/")
+		if query := c.QueryString(); query != "" {
+			target += "?" + query
+		}
+		return c.Redirect(http.StatusMovedPermanently, target)
+	}
+}
@@ -0,0 +1,184 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/blog"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"blogr.moe/backend/stripe"
+	"blogr.moe/backend/utils/mail"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	deletionGrace = 7 * 24 * time.Hour
+	// a claimed deletion that hasn't finished by then is tried again
+	deletionRetry = time.Hour
+)
+
+// Deletion is a scheduled account deletion. It is kept apart from the user so
+// it outlives the user's collection until the job has finished.
+type Deletion struct {
+	UUID        string     `bson:"_id" json:"-"`
+	Username    string     `bson:"username" json:"-"`
+	Email       string     `bson:"email" json:"-"`
+	RequestedAt time.Time  `bson:"requested_at" json:"requested_at"`
+	DeleteAt    time.Time  `bson:"delete_at" json:"delete_at"`
+	ClaimedAt   *time.Time `bson:"claimed_at,omitempty" json:"-"`
+}
+
+type DeletionRequest struct {
+	Password string `json:"password" form:"password"`
+}
+
+func deletions() *mongo.Collection {
+	return database.DB_Main.Collection("account_deletions")
+}
+
+// PendingDeletion returns the user's scheduled deletion, or nil.
+func PendingDeletion(ctx context.Context, uuid string) *Deletion {
+	var deletion Deletion
+	if err := deletions().FindOne(ctx, bson.M{"_id": uuid}).Decode(&deletion); err != nil {
+		if err != mongo.ErrNoDocuments {
+			logs.Error("Error fetching account deletion:", err)
+		}
+		return nil
+	}
+	return &deletion
+}
+
+// RequestDeletion schedules the logged in user's account for deletion once
+// the grace period is over. Until then it can be cancelled.
+func RequestDeletion(c echo.Context) error {
+	var req DeletionRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	user, status, msg := auth.Reauthenticate(c, req.Password)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	ctx := c.Request().Context()
+	if PendingDeletion(ctx, user.UUID) != nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Your account is already scheduled for deletion"})
+	}
+
+	deletion := Deletion{
+		UUID:        user.UUID,
+		Username:    user.Username,
+		Email:       user.Email,
+		RequestedAt: time.Now(),
+		DeleteAt:    time.Now().Add(deletionGrace),
+	}
+	if _, err := deletions().InsertOne(ctx, deletion); err != nil {
+		logs.Error("Error scheduling account deletion:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	logs.Info("User", user.Username, "scheduled their account for deletion on", deletion.DeleteAt.Format(time.RFC3339))
+
+	mail.AddMailToQueue(user.Email, "Your Blogr account will be deleted", fmt.Sprintf("Hi %s,\n\nYour Blogr account and everything you posted will be deleted on %s. "+
+		"Changed your mind? Log in and cancel the deletion from your dashboard at %s before then.",
+		user.Username, deletion.DeleteAt.Format("January 2, 2006"), auth.SiteURL()+"/dashboard"))
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Account scheduled for deletion", "delete_at": deletion.DeleteAt})
+}
+
+// CancelDeletion cancels the logged in user's scheduled deletion.
+func CancelDeletion(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.UUID == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	// a deletion that is already running can't be stopped
+	filter := bson.M{"_id": user.UUID, "claimed_at": bson.M{"$exists": false}}
+	res, err := deletions().DeleteOne(c.Request().Context(), filter)
+	if err != nil {
+		logs.Error("Error cancelling account deletion:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if res.DeletedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "No deletion to cancel"})
+	}
+	logs.Info("User", user.Username, "cancelled the deletion of their account")
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Account deletion cancelled"})
+}
+
+// ProcessDeletions queues the deletions whose grace period is over. Each one
+// is claimed first so it is only queued once.
+func ProcessDeletions() {
+	ctx := context.Background()
+	now := time.Now()
+	filter := bson.M{
+		"delete_at": bson.M{"$lte": now},
+		"$or": []bson.M{
+			{"claimed_at": bson.M{"$exists": false}},
+			{"claimed_at": bson.M{"$lte": now.Add(-deletionRetry)}},
+		},
+	}
+	claim := bson.M{"$set": bson.M{"claimed_at": now}}
+	for {
+		var deletion Deletion
+		err := deletions().FindOneAndUpdate(ctx, filter, claim, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&deletion)
+		if err == mongo.ErrNoDocuments {
+			return
+		}
+		if err != nil {
+			logs.Error("Error claiming account deletion:", err)
+			return
+		}
+		if err := deletionJobs.Enqueue(func() { deleteAccount(deletion) }); err != nil {
+			logs.Error("Error queueing account deletion:", err)
+			return
+		}
+	}
+}
+
+// deleteAccount ends the user's subscription, removes their posts and
+// everything else that belongs to them, then the account itself. Every step
+// can be run again, so a deletion that failed halfway is finished on the next
+// try.
+func deleteAccount(deletion Deletion) {
+	ctx := context.Background()
+	// the user may have been renamed since asking
+	if user, err := auth.GetUserByUUID(deletion.UUID); err == nil {
+		deletion.Username = user.Username
+		deletion.Email = user.Email
+		// Stripe would keep charging for an account that is gone
+		if err := stripe.EndSubscription(user); err != nil {
+			logs.Error("Error ending subscription of", deletion.UUID, err)
+			return
+		}
+	}
+	if err := blog.DeleteAuthor(ctx, deletion.UUID, deletion.Username); err != nil {
+		logs.Error("Error deleting posts of", deletion.UUID, err)
+		return
+	}
+	if err := auth.DeleteUser(ctx, deletion.UUID); err != nil {
+		logs.Error("Error deleting user", deletion.UUID, err)
+		return
+	}
+	if err := deleteExports(ctx, bson.M{"uuid": deletion.UUID}); err != nil {
+		logs.Error("Error deleting exports of", deletion.UUID, err)
+	}
+	if _, err := deletions().DeleteOne(ctx, bson.M{"_id": deletion.UUID}); err != nil {
+		logs.Error("Error deleting account deletion:", err)
+	}
+
+	for _, recount := range []func() error{database.GetTotalPostCount, database.GetTotalUserCount} {
+		if err := recount(); err != nil {
+			logs.Error(err)
+		}
+	}
+	logs.Info("Account", deletion.UUID, "deleted")
+
+	mail.AddMailToQueue(deletion.Email, "Your Blogr account has been deleted", fmt.Sprintf("Hi %s,\n\nYour Blogr account and everything you posted have been deleted.", deletion.Username))
+}
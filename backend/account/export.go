@@ -0,0 +1,356 @@
+package account
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/blog"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"blogr.moe/backend/stripe"
+	"blogr.moe/backend/utils/cache"
+	"blogr.moe/backend/utils/mail"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	exportTTL      = 48 * time.Hour
+	exportThrottle = time.Hour
+)
+
+// Export is a finished archive waiting to be downloaded. The link only
+// carries the token; its hash is stored.
+type Export struct {
+	TokenHash string             `bson:"token_hash"`
+	UUID      string             `bson:"uuid"`
+	FileID    primitive.ObjectID `bson:"file_id"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+// ExportProfile is the part of auth.User that goes into an export. Password
+// hashes and two-factor secrets are left out.
+type ExportProfile struct {
+	UUID                string `json:"uuid"`
+	Email               string `json:"email"`
+	Username            string `json:"username"`
+	Avatar              string `json:"avatar"`
+	LastLogin           string `json:"last_login"`
+	DateCreated         string `json:"date_created"`
+	Reputation          int    `json:"reputation"`
+	TotalViews          int    `json:"total_views"`
+	Role                string `json:"role"`
+	VerifiedEmail       bool   `json:"verified_email"`
+	Webhook             string `json:"webhook"`
+	Theme               string `json:"theme"`
+	CommentPolicy       string `json:"comment_policy"`
+	AutoTrustCommenters bool   `json:"auto_trust_commenters"`
+	TwoFactorEnabled    bool   `json:"two_factor_enabled"`
+}
+
+// ExportPayments is what we know about a user's payments.
+type ExportPayments struct {
+	Premium       bool             `json:"premium"`
+	PremiumExpiry string           `json:"premium_expiry"`
+	TransactionID string           `json:"transaction_id"`
+	History       []stripe.Payment `json:"history"`
+}
+
+func exports() *mongo.Collection {
+	return database.DB_Main.Collection("data_exports")
+}
+
+func exportBucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(database.DB_Main, options.GridFSBucket().SetName("exports"))
+}
+
+func hashExportToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestExport queues an archive of everything we hold about the logged in
+// user. A link to it is emailed when it is ready.
+func RequestExport(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.UUID == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	first, err := cache.Default().SetNX("export-throttle:"+user.UUID, "1", exportThrottle)
+	if err != nil {
+		logs.Error("Error throttling export:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if !first {
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "An export was requested recently, please wait an hour"})
+	}
+
+	if err := exportJobs.Enqueue(func() { buildExport(user.UUID) }); err != nil {
+		logs.Error("Error queueing export:", err)
+		cache.Default().Delete("export-throttle:" + user.UUID)
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Too many exports are being made, please try again later"})
+	}
+
+	return c.JSON(http.StatusAccepted, map[string]string{"message": "We'll email you a download link when your export is ready"})
+}
+
+// buildExport writes the user's archive to GridFS and emails them the link.
+func buildExport(uuid string) {
+	ctx := context.Background()
+	user, err := auth.GetUserByUUID(uuid)
+	if err != nil {
+		logs.Error("Error fetching user for export:", err)
+		return
+	}
+
+	bucket, err := exportBucket()
+	if err != nil {
+		logs.Error("Error opening export bucket:", err)
+		return
+	}
+	// the archive is written straight into GridFS rather than built in memory
+	name := fmt.Sprintf("blogr-%s-%s.zip", user.Username, time.Now().Format("2006-01-02"))
+	upload, err := bucket.OpenUploadStream(name)
+	if err != nil {
+		logs.Error("Error storing export:", err)
+		return
+	}
+	if err := writeArchive(ctx, user, upload); err != nil {
+		logs.Error("Error building export of", uuid, err)
+		upload.Abort()
+		return
+	}
+	if err := upload.Close(); err != nil {
+		logs.Error("Error storing export:", err)
+		return
+	}
+	fileID := upload.FileID.(primitive.ObjectID)
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		logs.Error("Error generating export token:", err)
+		return
+	}
+	token := hex.EncodeToString(b)
+	export := Export{
+		TokenHash: hashExportToken(token),
+		UUID:      uuid,
+		FileID:    fileID,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(exportTTL),
+	}
+	if _, err := exports().InsertOne(ctx, export); err != nil {
+		logs.Error("Error saving export:", err)
+		bucket.Delete(fileID)
+		return
+	}
+
+	link := auth.SiteURL() + "/api/user/export/" + token
+	mail.AddMailToQueue(user.Email, "Your Blogr data export is ready", fmt.Sprintf("Hi %s,\n\nYour data export is ready. Download it while logged in at:\n\n%s\n\n"+
+		"The link expires on %s.", user.Username, link, export.ExpiresAt.Format("January 2, 2006 15:04 MST")))
+}
+
+// writeArchive zips the user's profile, posts with their revisions and
+// images, comments, sessions, API tokens and payments into w.
+func writeArchive(ctx context.Context, user auth.User, w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	addJSON := func(name string, v interface{}) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	// images are copied from GridFS a chunk at a time
+	addImage := func(dir string, image primitive.ObjectID, prefix string) error {
+		stream, err := blog.OpenImage(image)
+		if err != nil {
+			logs.Error("Error reading image", image.Hex(), err)
+			return nil
+		}
+		defer stream.Close()
+		w, err := zw.Create(path.Join(dir, prefix+path.Base("/"+stream.GetFile().Name)))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, stream)
+		return err
+	}
+
+	profile := ExportProfile{
+		UUID:                user.UUID,
+		Email:               user.Email,
+		Username:            user.Username,
+		Avatar:              user.Avatar,
+		LastLogin:           user.LastLogin,
+		DateCreated:         user.DateCreated,
+		Reputation:          user.Reputation,
+		TotalViews:          user.TotalViews,
+		Role:                auth.RoleName(user.Role()),
+		VerifiedEmail:       user.VerifiedEmail,
+		Webhook:             user.Webhook,
+		Theme:               user.Theme,
+		CommentPolicy:       user.CommentPolicy,
+		AutoTrustCommenters: user.AutoTrustCommenters,
+		TwoFactorEnabled:    user.TOTPEnabled,
+	}
+	if err := addJSON("profile.json", profile); err != nil {
+		return err
+	}
+
+	posts, err := blog.GetUserPosts(ctx, user.UUID)
+	if err != nil {
+		return err
+	}
+	revs, err := blog.GetUserRevisions(ctx, user.UUID)
+	if err != nil {
+		return err
+	}
+	revisions := make(map[string][]blog.Revision)
+	for _, rev := range revs {
+		revisions[rev.BlogID] = append(revisions[rev.BlogID], rev)
+	}
+	for _, post := range posts {
+		dir := path.Join("posts", post.BlogID)
+		if err := addJSON(path.Join(dir, "post.json"), post); err != nil {
+			return err
+		}
+		if !post.Image.IsZero() {
+			if err := addImage(dir, post.Image, ""); err != nil {
+				return err
+			}
+		}
+		if len(revisions[post.BlogID]) == 0 {
+			continue
+		}
+		if err := addJSON(path.Join(dir, "revisions.json"), revisions[post.BlogID]); err != nil {
+			return err
+		}
+		// older images are only kept for revisions, so they go in with them
+		seen := map[primitive.ObjectID]bool{post.Image: true}
+		for _, rev := range revisions[post.BlogID] {
+			if rev.Image.IsZero() || seen[rev.Image] {
+				continue
+			}
+			seen[rev.Image] = true
+			if err := addImage(path.Join(dir, "revisions"), rev.Image, fmt.Sprintf("%d-", rev.Number)); err != nil {
+				return err
+			}
+		}
+	}
+
+	written, err := blog.GetUserComments(ctx, user.UUID)
+	if err != nil {
+		return err
+	}
+	if err := addJSON("comments.json", written); err != nil {
+		return err
+	}
+
+	sessions, err := auth.UserSessions(user.UUID, "")
+	if err != nil {
+		return err
+	}
+	if err := addJSON("sessions.json", sessions); err != nil {
+		return err
+	}
+
+	tokens, err := auth.UserTokens(ctx, user.UUID)
+	if err != nil {
+		return err
+	}
+	if err := addJSON("api_tokens.json", tokens); err != nil {
+		return err
+	}
+
+	history, err := stripe.GetPayments(ctx, user.UUID)
+	if err != nil {
+		return err
+	}
+	payments := ExportPayments{Premium: user.Premium, PremiumExpiry: user.PremiumExpiry, TransactionID: user.TransactionID, History: history}
+	if err := addJSON("payments.json", payments); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// DownloadExport streams an export to the user it was made for.
+func DownloadExport(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.UUID == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Log in to download your export"})
+	}
+
+	var export Export
+	filter := bson.M{"token_hash": hashExportToken(c.Param("token")), "uuid": user.UUID, "expires_at": bson.M{"$gt": time.Now()}}
+	if err := exports().FindOne(c.Request().Context(), filter).Decode(&export); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "This export doesn't exist or has expired"})
+	}
+
+	bucket, err := exportBucket()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	stream, err := bucket.OpenDownloadStream(export.FileID)
+	if err != nil {
+		logs.Error("Error opening export:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	defer stream.Close()
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", stream.GetFile().Name))
+	return c.Stream(http.StatusOK, "application/zip", stream)
+}
+
+// deleteExports removes exports and their archives. It is used both for
+// expired exports and for all exports of a deleted account.
+func deleteExports(ctx context.Context, filter bson.M) error {
+	cursor, err := exports().Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var expired []Export
+	if err := cursor.All(ctx, &expired); err != nil {
+		return err
+	}
+	bucket, err := exportBucket()
+	if err != nil {
+		return err
+	}
+	for _, export := range expired {
+		if err := bucket.Delete(export.FileID); err != nil && err != gridfs.ErrFileNotFound {
+			return err
+		}
+		if _, err := exports().DeleteOne(ctx, bson.M{"token_hash": export.TokenHash}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpireExports deletes exports whose link has expired.
+func ExpireExports() {
+	if err := deleteExports(context.Background(), bson.M{"expires_at": bson.M{"$lte": time.Now()}}); err != nil {
+		logs.Error("Error expiring exports:", err)
+	}
+}
@@ -0,0 +1,252 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"blogr.moe/backend/account"
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"blogr.moe/backend/utils/mail"
+	"blogr.moe/backend/utils/scheduler"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	usersPerPage = int64(20)
+	startedAt    = time.Now()
+)
+
+// AdminUser is a user as listed in the admin panel.
+type AdminUser struct {
+	UUID          string `json:"uuid"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	GroupID       uint   `json:"group_id"`
+	Premium       bool   `json:"premium"`
+	PremiumExpiry string `json:"premium_expiry"`
+	Suspended     bool   `json:"suspended"`
+	VerifiedEmail bool   `json:"verified_email"`
+	DateCreated   string `json:"date_created"`
+}
+
+type PremiumRequest struct {
+	Days int `json:"days"`
+}
+
+type RoleRequest struct {
+	GroupID uint `json:"group_id"`
+}
+
+func toAdminUser(u auth.User) AdminUser {
+	return AdminUser{
+		UUID:          u.UUID,
+		Username:      u.Username,
+		Email:         u.Email,
+		Role:          auth.RoleName(u.Role()),
+		GroupID:       u.GroupID,
+		Premium:       u.Premium,
+		PremiumExpiry: u.PremiumExpiry,
+		Suspended:     u.Suspended,
+		VerifiedEmail: u.VerifiedEmail,
+		DateCreated:   u.DateCreated,
+	}
+}
+
+// SearchUsers looks users up by username or email in DB_UserList.users.
+func SearchUsers(c echo.Context) error {
+	ctx := c.Request().Context()
+	page, err := strconv.ParseInt(c.QueryParam("page"), 10, 64)
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	filter := bson.M{}
+	if q := c.QueryParam("q"); q != "" {
+		pattern := bson.M{"$regex": regexp.QuoteMeta(q), "$options": "i"}
+		filter = bson.M{"$or": []bson.M{{"username": pattern}, {"email": pattern}}}
+	}
+
+	total, err := database.DB_UserList.Collection("users").CountDocuments(ctx, filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error searching users"})
+	}
+	opts := options.Find().SetSort(bson.M{"username": 1}).SetSkip((page - 1) * usersPerPage).SetLimit(usersPerPage)
+	cursor, err := database.DB_UserList.Collection("users").Find(ctx, filter, opts)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error searching users"})
+	}
+	var entries []auth.UserList
+	if err := cursor.All(ctx, &entries); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error searching users"})
+	}
+
+	uuids := make([]string, len(entries))
+	for i, entry := range entries {
+		uuids[i] = entry.UUID
+	}
+	found, err := auth.GetUsersByUUID(ctx, uuids)
+	if err != nil {
+		logs.Error("Error fetching users:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error searching users"})
+	}
+	byUUID := make(map[string]auth.User, len(found))
+	for _, user := range found {
+		byUUID[user.UUID] = user
+	}
+
+	// kept in the order of the user list
+	users := []AdminUser{}
+	for _, entry := range entries {
+		if user, ok := byUUID[entry.UUID]; ok {
+			users = append(users, toAdminUser(user))
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"users": users, "total": total, "page": page})
+}
+
+// targetUser loads the user named by :uuid. Admins can't act on themselves,
+// so nobody can lock themselves out of the panel by accident.
+func targetUser(c echo.Context) (auth.User, int, string) {
+	user, err := auth.GetUserByUUID(c.Param("uuid"))
+	if err != nil {
+		return auth.User{}, http.StatusNotFound, "User not found"
+	}
+	if user.UUID == auth.GetUserFromContext(c).UUID {
+		return auth.User{}, http.StatusBadRequest, "You can't change your own account here"
+	}
+	return user, http.StatusOK, ""
+}
+
+func updateUser(ctx context.Context, uuid string, update bson.M) error {
+	_, err := database.DB_Users.Collection(uuid).UpdateOne(ctx, bson.M{"uuid": uuid}, update)
+	return err
+}
+
+// SuspendUser stops a user from logging in and ends their sessions.
+func SuspendUser(c echo.Context) error {
+	user, status, msg := targetUser(c)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	if err := updateUser(c.Request().Context(), user.UUID, bson.M{"$set": bson.M{"suspended": true}}); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error suspending user"})
+	}
+	if err := auth.RevokeSessions(user.UUID); err != nil {
+		logs.Error("Error revoking sessions:", err)
+	}
+	logs.Info("User", user.Username, "suspended by", auth.GetUserFromContext(c).Username)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "User suspended"})
+}
+
+// UnsuspendUser lets a suspended user log in again.
+func UnsuspendUser(c echo.Context) error {
+	user, status, msg := targetUser(c)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	if err := updateUser(c.Request().Context(), user.UUID, bson.M{"$set": bson.M{"suspended": false}}); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error unsuspending user"})
+	}
+	logs.Info("User", user.Username, "unsuspended by", auth.GetUserFromContext(c).Username)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "User unsuspended"})
+}
+
+// GrantPremium gives a user premium for the given number of days.
+func GrantPremium(c echo.Context) error {
+	user, status, msg := targetUser(c)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	var req PremiumRequest
+	if err := c.Bind(&req); err != nil || req.Days < 1 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Days must be at least 1"})
+	}
+
+	expiry := time.Now().AddDate(0, 0, req.Days).Format(time.RFC3339)
+	update := bson.M{"$set": bson.M{"premium": true, "premiumexpiry": expiry}}
+	if err := updateUser(c.Request().Context(), user.UUID, update); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error granting premium"})
+	}
+	logs.Info("Premium granted to", user.Username, "until", expiry, "by", auth.GetUserFromContext(c).Username)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Premium granted", "premium_expiry": expiry})
+}
+
+// RevokePremium takes premium away from a user.
+func RevokePremium(c echo.Context) error {
+	user, status, msg := targetUser(c)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	update := bson.M{"$set": bson.M{"premium": false, "premiumexpiry": ""}}
+	if err := updateUser(c.Request().Context(), user.UUID, update); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error revoking premium"})
+	}
+	logs.Info("Premium revoked from", user.Username, "by", auth.GetUserFromContext(c).Username)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Premium revoked"})
+}
+
+// SetRole changes a user's role.
+func SetRole(c echo.Context) error {
+	user, status, msg := targetUser(c)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	var req RoleRequest
+	if err := c.Bind(&req); err != nil || !auth.ValidRole(req.GroupID) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid role"})
+	}
+	if err := updateUser(c.Request().Context(), user.UUID, bson.M{"$set": bson.M{"groupid": req.GroupID}}); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error updating role"})
+	}
+	logs.Info("User", user.Username, "is now", auth.RoleName(req.GroupID), "set by", auth.GetUserFromContext(c).Username)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Role updated"})
+}
+
+// GetStats returns the stats document.
+func GetStats(c echo.Context) error {
+	stats, err := database.GetStats()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// RecomputeStats recounts posts, users and comments from the data itself.
+func RecomputeStats(c echo.Context) error {
+	for _, recount := range []func() error{database.GetTotalPostCount, database.GetTotalUserCount, database.GetTotalCommentCount} {
+		if err := recount(); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		}
+	}
+	return GetStats(c)
+}
+
+// Health reports the mail and account queue backlogs and how the scheduled tasks are running.
+func Health(c echo.Context) error {
+	cacheBackend := "memory"
+	if os.Getenv("REDIS_ADDR") != "" {
+		cacheBackend = "redis"
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"started_at": startedAt,
+		"uptime":     time.Since(startedAt).Round(time.Second).String(),
+		"cache":      cacheBackend,
+		"queues":     append(mail.QueueStats(), account.QueueStats()...),
+		"tasks":      scheduler.Status(),
+	})
+}
@@ -5,18 +5,17 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/gob"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"blogr.moe/backend/database"
 	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/scrypt"
 )
 
@@ -30,39 +29,114 @@ type UserCollection struct {
 }
 
 type User struct {
-	ID            uint   `json:"id" gorm:"primary_key"`
-	UUID          string `json:"uuid"`
-	Email         string `json:"email"`
-	Username      string `json:"username"`
-	Password      string `json:"password"`
-	Avatar        string `json:"avatar"`
-	LastLogin     string `json:"last_login"`
-	DateCreated   string `json:"date_created"`
-	Reputation    int    `json:"reputation"`
-	TotalViews    int    `json:"total_views"`
-	GroupID       uint   `json:"group_id"`
-	Premium       bool   `json:"premium"`
-	PremiumExpiry string `json:"premium_expiry"`
-	TransactionID string `json:"transaction_id"`
-	VerifiedEmail bool   `json:"verified_email"`
-	Webhook       string `json:"webhook"`
-	Theme         string `json:"theme"`
+	ID                  uint   `json:"id" gorm:"primary_key"`
+	UUID                string `json:"uuid"`
+	Email               string `json:"email"`
+	Username            string `json:"username"`
+	Password            string `json:"password"`
+	Avatar              string `json:"avatar"`
+	LastLogin           string `json:"last_login"`
+	DateCreated         string `json:"date_created"`
+	Reputation          int    `json:"reputation"`
+	TotalViews          int    `json:"total_views"`
+	GroupID             uint   `json:"group_id"`
+	Premium             bool   `json:"premium"`
+	PremiumExpiry       string `json:"premium_expiry"`
+	TransactionID       string `json:"transaction_id"`
+	VerifiedEmail       bool   `json:"verified_email"`
+	Webhook             string `json:"webhook"`
+	Theme               string `json:"theme"`
+	CommentPolicy       string `json:"comment_policy"`
+	AutoTrustCommenters bool   `json:"auto_trust_commenters"`
+	Suspended           bool   `json:"suspended"`
+
+	// premium is a Stripe subscription; PremiumExpiry follows its billing period
+	StripeCustomerID     string `json:"-"`
+	StripeSubscriptionID string `json:"-"`
+	SubscriptionPlan     string `json:"subscription_plan"`
+	SubscriptionStatus   string `json:"subscription_status"`
+	CancelAtPeriodEnd    bool   `json:"cancel_at_period_end"`
+
+	// two-factor secrets and hashed recovery codes never leave the server
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	TOTPSecret    string   `json:"-"`
+	TOTPPending   string   `json:"-"`
+	RecoveryCodes []string `json:"-"`
+}
+
+// PublicProfile is the part of a User that may be shown to anyone.
+type PublicProfile struct {
+	Username    string `json:"username"`
+	Avatar      string `json:"avatar"`
+	Reputation  int    `json:"reputation"`
+	TotalViews  int    `json:"total_views"`
+	DateCreated string `json:"date_created"`
+}
+
+func (u User) Public() PublicProfile {
+	return PublicProfile{
+		Username:    u.Username,
+		Avatar:      u.Avatar,
+		Reputation:  u.Reputation,
+		TotalViews:  u.TotalViews,
+		DateCreated: u.DateCreated,
+	}
+}
+
+// PageUser is the part of the logged in user that page templates see.
+// Password hashes and two-factor secrets are left out.
+type PageUser struct {
+	Username             string
+	Email                string
+	Avatar               string
+	Theme                string
+	Webhook              string
+	CommentPolicy        string
+	AutoTrustCommenters  bool
+	PremiumActive        bool
+	StripeCustomerID     string
+	StripeSubscriptionID string
+	SubscriptionPlan     string
+	SubscriptionStatus   string
+	CancelAtPeriodEnd    bool
+	role                 uint
+}
+
+func (u User) Page() PageUser {
+	return PageUser{
+		Username:             u.Username,
+		Email:                u.Email,
+		Avatar:               u.Avatar,
+		Theme:                u.Theme,
+		Webhook:              u.Webhook,
+		CommentPolicy:        u.CommentPolicy,
+		AutoTrustCommenters:  u.AutoTrustCommenters,
+		PremiumActive:        u.PremiumActive(),
+		StripeCustomerID:     u.StripeCustomerID,
+		StripeSubscriptionID: u.StripeSubscriptionID,
+		SubscriptionPlan:     u.SubscriptionPlan,
+		SubscriptionStatus:   u.SubscriptionStatus,
+		CancelAtPeriodEnd:    u.CancelAtPeriodEnd,
+		role:                 u.Role(),
+	}
+}
+
+// Can reports whether the user has a permission.
+func (u PageUser) Can(permission string) bool {
+	return roleCan(u.role, permission)
 }
 
 type UserList struct {
-	Username string `json:"username"`
-	UUID     string `json:"uuid"`
-	Email    string `json:"email"`
+	Username         string `json:"username"`
+	UUID             string `json:"uuid"`
+	Email            string `json:"email"`
+	StripeCustomerID string `json:"-"`
 }
 
 type Stats struct {
 	TotalUsers int `json:"total_users"`
 }
 
-func init() {
-	gob.Register(&User{}) // Register the pointer type as well
-}
-
 type UserRegister struct {
 	Email    string `json:"email"`
 	Username string `json:"username"`
@@ -79,6 +153,28 @@ func Register(c echo.Context) error {
 	if user.Email == "" || user.Username == "" || user.Password == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
 	}
+	if !ValidUsername(user.Username) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Usernames are 3 to 32 letters, numbers, - or _"})
+	}
+	// checked and stored the same way, or " a@b.com " would pass as new
+	user.Email = NormalizeEmail(user.Email)
+	ctx := c.Request().Context()
+	usernameTaken, err := UsernameTaken(ctx, user.Username, "")
+	if err != nil {
+		log.Println("Error checking username:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if usernameTaken {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "That username is taken"})
+	}
+	emailTaken, err := EmailTaken(ctx, user.Email, "")
+	if err != nil {
+		log.Println("Error checking email:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if emailTaken {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "That email is already in use"})
+	}
 
 	uuid := uuid.New().String()
 	hash, err := hashPassword(user.Password)
@@ -115,11 +211,20 @@ func Register(c echo.Context) error {
 	}
 
 	_, err = database.DB_UserList.Collection("users").InsertOne(context.Background(), map[string]string{"username": user.Username, "uuid": uuid, "email": user.Email})
+	if mongo.IsDuplicateKeyError(err) {
+		// someone registered the email since EmailTaken
+		if err := database.DB_Users.Collection(uuid).Drop(context.Background()); err != nil {
+			log.Println("Error removing user:", err)
+		}
+		return c.JSON(http.StatusConflict, map[string]string{"error": "That email is already in use"})
+	}
 	if err != nil {
 		log.Println("Error inserting user:", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 	}
 
+	SendVerificationEmail(userDoc)
+
 	return c.JSON(http.StatusOK, map[string]string{"message": "User created"})
 }
 
@@ -134,61 +239,44 @@ func Login(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
 	}
 
-	usrList := &UserList{}
-	userDoc := &User{}
-
-	// find user by email, the collections are named by the user's UUID
-	err := database.DB_UserList.Collection("users").FindOne(context.Background(), map[string]string{"email": user.Email}).Decode(&usrList)
-	if err != nil {
-		log.Println("Error finding user:", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cant find user"})
+	// the lockout and the lookup both go by the normalised email, so differently
+	// cased attempts count against the same account
+	email := NormalizeEmail(user.Email)
+	if wait := loginBlocked(email, c.RealIP()); wait > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many failed attempts, try again later"})
 	}
 
-	err = database.DB_Users.Collection(usrList.UUID).FindOne(context.Background(), map[string]string{"email": user.Email}).Decode(&userDoc)
+	found, err := GetUserByEmail(email)
 	if err != nil {
 		log.Println("Error finding user:", err)
+		recordLoginFailure(c, email, nil)
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cant find user"})
 	}
+	userDoc := &found
 
 	if !checkPassword(user.Password, userDoc.Password) {
+		recordLoginFailure(c, email, userDoc)
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
 	}
+	clearLoginFailures(email)
+	auditLogin(c, AuditLoginSuccess, email, userDoc.UUID)
 
-	session, err := session.Get("session", c)
-	if err != nil {
-		log.Println("Error getting session:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	if userDoc.Suspended {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "This account has been suspended"})
 	}
-	session.Options = &sessions.Options{
-		Path:   "/",
-		MaxAge: 86400,
-		Domain: os.Getenv("BASE_URL"),
-
-		Secure:   true,
-		HttpOnly: false,
-
-		SameSite: http.SameSiteStrictMode,
-	}
-
-	session.Values["user"] = User{
-		ID:            userDoc.ID,
-		UUID:          userDoc.UUID,
-		Email:         userDoc.Email,
-		Username:      userDoc.Username,
-		Avatar:        userDoc.Avatar,
-		LastLogin:     userDoc.LastLogin,
-		DateCreated:   userDoc.DateCreated,
-		Reputation:    userDoc.Reputation,
-		TotalViews:    userDoc.TotalViews,
-		GroupID:       userDoc.GroupID,
-		Premium:       userDoc.Premium,
-		PremiumExpiry: userDoc.PremiumExpiry,
-		TransactionID: userDoc.TransactionID,
-		VerifiedEmail: userDoc.VerifiedEmail,
-		Webhook:       userDoc.Webhook,
-		Theme:         userDoc.Theme,
-	}
-	if err := session.Save(c.Request(), c.Response()); err != nil {
+
+	// with two-factor enabled the session stays pending until LoginTwoFactor
+	// gets a valid code
+	if userDoc.TOTPEnabled {
+		if _, err := createSession(c, userDoc.UUID, true); err != nil {
+			log.Println("Error saving session:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Two-factor code required", "two_factor": "required"})
+	}
+
+	if err := startSession(c, userDoc); err != nil {
 		log.Println("Error saving session:", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 	}
@@ -197,19 +285,13 @@ func Login(c echo.Context) error {
 }
 
 func Logout(c echo.Context) error {
-	session, err := session.Get("session", c)
-	if err != nil {
-		log.Println("Error getting session:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
-	}
-
-	// Invalidate the session
-	session.Options.MaxAge = -1
-
-	if err := session.Save(c.Request(), c.Response()); err != nil {
-		log.Println("Error saving session:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	if current := currentSession(c); current != nil {
+		if err := deleteSession(current); err != nil {
+			log.Println("Error deleting session:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
 	}
+	setSessionCookie(c, "", -1)
 
 	return c.Redirect(http.StatusFound, "/")
 }
@@ -300,28 +382,34 @@ func GetUserByID(c echo.Context) error {
 	return c.JSON(http.StatusOK, userDoc)
 }
 
+// UpdateUser changes the logged in user's avatar and theme. Email, username
+// and password have their own endpoints because they need extra checks.
 func UpdateUser(c echo.Context) error {
-	user := c.Get("user").(User)
-	var userUpdate User
-	if err := c.Bind(&userUpdate); err != nil {
+	user := GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	var req ProfileRequest
+	if err := c.Bind(&req); err != nil {
 		log.Println("Error binding user:", err)
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
 	}
 
-	if userUpdate.Email != "" {
-		user.Email = userUpdate.Email
-	}
-	if userUpdate.Username != "" {
-		user.Username = userUpdate.Username
+	set := bson.M{}
+	if req.Avatar != "" {
+		set["avatar"] = req.Avatar
 	}
-	if userUpdate.Avatar != "" {
-		user.Avatar = userUpdate.Avatar
+	if req.Theme != "" {
+		if req.Theme != "light" && req.Theme != "dark" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid theme"})
+		}
+		set["theme"] = req.Theme
 	}
-	if userUpdate.Theme != "" {
-		user.Theme = userUpdate.Theme
+	if len(set) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Nothing to update"})
 	}
 
-	_, err := database.DB_Users.Collection(user.UUID).UpdateOne(context.Background(), map[string]string{"uuid": user.UUID}, user)
+	_, err := database.DB_Users.Collection(user.UUID).UpdateOne(context.Background(), bson.M{"uuid": user.UUID}, bson.M{"$set": set})
 	if err != nil {
 		log.Println("Error updating user:", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
@@ -329,53 +417,79 @@ func UpdateUser(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{"message": "User updated"})
 }
 
-func DeleteUser(c echo.Context) error {
-	user := c.Get("user").(User)
-	_, err := database.DB_Users.Collection("users").DeleteOne(context.Background(), map[string]string{"uuid": user.UUID})
-	if err != nil {
-		log.Println("Error deleting user:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+// DeleteUser removes an account and everything auth keeps about it: the
+// user's collection, its DB_UserList entry, sessions, API tokens, password
+// resets and username redirects. Posts are removed separately by the blog.
+func DeleteUser(ctx context.Context, uuid string) error {
+	if err := RevokeSessions(uuid); err != nil {
+		return err
 	}
-	return c.JSON(http.StatusOK, map[string]string{"message": "User deleted"})
+	if _, err := apiTokens().DeleteMany(ctx, bson.M{"uuid": uuid}); err != nil {
+		return err
+	}
+	if _, err := database.DB_Main.Collection("password_resets").DeleteMany(ctx, bson.M{"uuid": uuid}); err != nil {
+		return err
+	}
+	if _, err := usernameRedirects().DeleteMany(ctx, bson.M{"uuid": uuid}); err != nil {
+		return err
+	}
+	if _, err := database.DB_UserList.Collection("users").DeleteOne(ctx, bson.M{"uuid": uuid}); err != nil {
+		return err
+	}
+	return database.DB_Users.Collection(uuid).Drop(ctx)
 }
 
+// GetUserFromContext returns the logged in user, or an empty User. The user is
+// read from the database once per request, so it is never stale. A bearer
+// token takes the place of the session on routes that accept tokens.
 func GetUserFromContext(c echo.Context) User {
-	session, err := session.Get("session", c)
-	if err != nil {
-		log.Println("Error getting session:", err)
+	if user, ok := c.Get("user").(User); ok {
+		return user
+	}
+	if token := BearerToken(c); token != "" {
+		user, ok := userFromToken(c, token)
+		if !ok {
+			return User{}
+		}
+		c.Set("user", user)
+		return user
+	}
+	current := currentSession(c)
+	if current == nil || current.Pending {
 		return User{}
 	}
-	user := session.Values["user"]
-	if user == nil {
+	user, err := GetUserByUUID(current.UUID)
+	if err != nil {
+		log.Println("Error finding user:", err)
 		return User{}
 	}
-	if u, ok := user.(*User); ok {
-		return *u
+	if user.Suspended {
+		return User{}
 	}
-	return User{}
+	c.Set("user", user)
+	return user
 }
 
 func IsLoggedIn(c echo.Context) bool {
-	session, err := session.Get("session", c)
-	if err != nil {
-		log.Println("Error getting session:", err)
-		return false
-	}
-	user := session.Values["user"]
-	if user == nil {
-		return false
-	}
-	return true
+	return GetUserFromContext(c).UUID != ""
 }
 
 func IsPremium(c echo.Context) bool {
-	user := c.Get("user").(User)
-	return user.Premium
+	return GetUserFromContext(c).PremiumActive()
 }
 
 func GetUserByEmail(email string) (User, error) {
 	userDoc := User{}
-	err := database.DB_Users.Collection("users").FindOne(context.Background(), map[string]string{"email": email}).Decode(&userDoc)
+	userList := UserList{}
+
+	// the user list maps emails to the per-user collections, which are named by
+	// UUID. Emails are unique ignoring case, and older accounts aren't lower case.
+	err := database.DB_UserList.Collection("users").FindOne(context.Background(), bson.M{"email": exactMatch(NormalizeEmail(email))}).Decode(&userList)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = database.DB_Users.Collection(userList.UUID).FindOne(context.Background(), map[string]string{"uuid": userList.UUID}).Decode(&userDoc)
 	if err != nil {
 		return User{}, err
 	}
@@ -391,28 +505,55 @@ func GetUserByUUID(uuid string) (User, error) {
 	return userDoc, nil
 }
 
-func IsPaymentActive(c echo.Context) bool {
-	user := c.Get("user").(User)
-	if !user.Premium {
-		return false
-	}
-	expiry, err := time.Parse(time.RFC3339, user.PremiumExpiry)
+// GetUsersByUUID loads several users with one query, in no particular order.
+// Each user has their own collection, so the lookups are joined with $unionWith.
+func GetUsersByUUID(ctx context.Context, uuids []string) ([]User, error) {
+	users := []User{}
+	if len(uuids) == 0 {
+		return users, nil
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"uuid": uuids[0]}}}}
+	for _, uuid := range uuids[1:] {
+		pipeline = append(pipeline, bson.D{{Key: "$unionWith", Value: bson.M{
+			"coll":     uuid,
+			"pipeline": bson.A{bson.M{"$match": bson.M{"uuid": uuid}}},
+		}}})
+	}
+	cursor, err := database.DB_Users.Collection(uuids[0]).Aggregate(ctx, pipeline)
 	if err != nil {
-		return false
+		return nil, err
 	}
-	if time.Now().After(expiry) {
-		return false
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
 	}
-	return true
+	return users, nil
 }
 
-func VerifyEmail(c echo.Context) error {
-	user := c.Get("user").(User)
-	user.VerifiedEmail = true
-	_, err := database.DB_Users.Collection(user.UUID).UpdateOne(c.Request().Context(), map[string]string{"email": user.Email}, user)
+// ExpirePremium clears the premium flag of users whose premium has run out.
+// PremiumActive already ignores it; this keeps the stored flag honest for
+// anything that reads it directly.
+func ExpirePremium() {
+	ctx := context.Background()
+	cursor, err := database.DB_UserList.Collection("users").Find(ctx, bson.M{})
 	if err != nil {
-		log.Println("Error updating user:", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		log.Println("Error listing users:", err)
+		return
+	}
+	var entries []UserList
+	if err := cursor.All(ctx, &entries); err != nil {
+		log.Println("Error listing users:", err)
+		return
+	}
+	for _, entry := range entries {
+		user, err := GetUserByUUID(entry.UUID)
+		if err != nil || !user.Premium || user.PremiumActive() {
+			continue
+		}
+		_, err = database.DB_Users.Collection(user.UUID).UpdateOne(ctx, bson.M{"uuid": user.UUID}, bson.M{"$set": bson.M{"premium": false}})
+		if err != nil {
+			log.Println("Error expiring premium:", err)
+			continue
+		}
+		log.Println("Premium expired for", user.Username)
 	}
-	return c.JSON(http.StatusOK, map[string]string{"message": "Email verified"})
 }
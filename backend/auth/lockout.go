@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/utils/cache"
+	"blogr.moe/backend/utils/mail"
+	"github.com/labstack/echo/v4"
+)
+
+// Failed logins are counted per account and per IP within loginFailureWindow.
+// After loginFreeAttempts every failure doubles the wait before the next try,
+// and enough failures lock the account or IP for lockoutDuration.
+var (
+	loginFailureWindow  = 15 * time.Minute
+	loginFreeAttempts   = int64(3)
+	loginMaxBackoff     = 5 * time.Minute
+	accountLockoutAfter = int64(10)
+	ipLockoutAfter      = int64(50)
+	lockoutDuration     = 15 * time.Minute
+)
+
+// Login audit events
+const (
+	AuditLoginFailed  = "login_failed"
+	AuditLoginSuccess = "login_success"
+	AuditAccountLock  = "account_locked"
+	AuditIPLock       = "ip_locked"
+)
+
+type LoginAudit struct {
+	Event     string    `bson:"event" json:"event"`
+	Email     string    `bson:"email" json:"email"`
+	UUID      string    `bson:"uuid,omitempty" json:"uuid,omitempty"`
+	IP        string    `bson:"ip" json:"ip"`
+	UserAgent string    `bson:"user_agent" json:"user_agent"`
+	Date      time.Time `bson:"date" json:"date"`
+}
+
+func auditLogin(c echo.Context, event string, email string, uuid string) {
+	record := LoginAudit{
+		Event:     event,
+		Email:     email,
+		UUID:      uuid,
+		IP:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+		Date:      time.Now(),
+	}
+	if _, err := database.DB_Main.Collection("login_audit").InsertOne(c.Request().Context(), record); err != nil {
+		log.Println("Error saving login audit:", err)
+	}
+}
+
+// block stores the time a block ends, so callers can tell how long is left.
+func block(key string, d time.Duration) (bool, error) {
+	until := strconv.FormatInt(time.Now().Add(d).UnixNano(), 10)
+	return cache.Default().SetNX(key, until, d)
+}
+
+// loginBlocked returns how long the account or IP has to wait before it may
+// try to log in again, or zero.
+func loginBlocked(email string, ip string) time.Duration {
+	var wait time.Duration
+	for _, key := range []string{
+		"login-locked:acct:" + email,
+		"login-locked:ip:" + ip,
+		"login-wait:acct:" + email,
+		"login-wait:ip:" + ip,
+	} {
+		value, err := cache.Default().Get(key)
+		if err != nil {
+			continue
+		}
+		until, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		if left := time.Until(time.Unix(0, until)); left > wait {
+			wait = left
+		}
+	}
+	return wait
+}
+
+func backoff(failures int64) time.Duration {
+	if failures <= loginFreeAttempts {
+		return 0
+	}
+	n := failures - loginFreeAttempts - 1
+	if n > 16 {
+		return loginMaxBackoff
+	}
+	d := time.Second << n
+	if d > loginMaxBackoff {
+		return loginMaxBackoff
+	}
+	return d
+}
+
+// recordLoginFailure counts a failed login for the email and the client IP.
+// user is nil when the email isn't registered.
+func recordLoginFailure(c echo.Context, email string, user *User) {
+	ip := c.RealIP()
+	uuid := ""
+	if user != nil {
+		uuid = user.UUID
+	}
+	auditLogin(c, AuditLoginFailed, email, uuid)
+
+	accountFailures, err := cache.Default().Incr("login-fail:acct:"+email, loginFailureWindow)
+	if err != nil {
+		log.Println("Error counting failed login:", err)
+		return
+	}
+	ipFailures, err := cache.Default().Incr("login-fail:ip:"+ip, loginFailureWindow)
+	if err != nil {
+		log.Println("Error counting failed login:", err)
+		return
+	}
+
+	if d := backoff(accountFailures); d > 0 {
+		cache.Default().Set("login-wait:acct:"+email, strconv.FormatInt(time.Now().Add(d).UnixNano(), 10), d)
+	}
+	if d := backoff(ipFailures); d > 0 {
+		cache.Default().Set("login-wait:ip:"+ip, strconv.FormatInt(time.Now().Add(d).UnixNano(), 10), d)
+	}
+
+	if accountFailures >= accountLockoutAfter {
+		if first, _ := block("login-locked:acct:"+email, lockoutDuration); first {
+			auditLogin(c, AuditAccountLock, email, uuid)
+			if user != nil {
+				sendLockoutEmail(user, ip)
+			}
+		}
+	}
+	if ipFailures >= ipLockoutAfter {
+		if first, _ := block("login-locked:ip:"+ip, lockoutDuration); first {
+			auditLogin(c, AuditIPLock, email, uuid)
+		}
+	}
+}
+
+// clearLoginFailures forgets an account's failures after a successful login.
+// IP counters are left alone so an attacker can't reset them with an account
+// of their own.
+func clearLoginFailures(email string) {
+	cache.Default().Delete("login-fail:acct:" + email)
+	cache.Default().Delete("login-wait:acct:" + email)
+}
+
+func sendLockoutEmail(user *User, ip string) {
+	body := fmt.Sprintf("Hi %s,\n\nThere were %d failed attempts to log in to your Blogr account, the last one from %s, "+
+		"so logging in has been paused for %d minutes.\n\nIf this wasn't you, consider resetting your password: %s\n",
+		user.Username, accountLockoutAfter, ip, int(lockoutDuration.Minutes()), SiteURL()+"/forgot-password")
+	mail.AddMailToQueue(user.Email, "Failed login attempts on your Blogr account", body)
+}
+
+// NormalizeEmail trims and lower-cases an email for storing and lookups.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
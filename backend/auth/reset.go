@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/utils/cache"
+	"blogr.moe/backend/utils/mail"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	resetTokenTTL      = time.Hour
+	resetThrottle      = 2 * time.Minute
+	minPasswordLength  = 8
+	forgotPasswordText = "If an account exists for that email, a reset link has been sent."
+)
+
+// PasswordReset is a single-use reset token. Only the SHA-256 of the token is
+// stored; the token itself only exists in the emailed link.
+type PasswordReset struct {
+	TokenHash string    `bson:"token_hash"`
+	UUID      string    `bson:"uuid"`
+	ExpiresAt time.Time `bson:"expires_at"`
+	Used      bool      `bson:"used"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" form:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" form:"token"`
+	Password string `json:"password" form:"password"`
+}
+
+// SiteURL is the absolute base URL used in emailed links and feeds.
+func SiteURL() string {
+	base := os.Getenv("BASE_URL")
+	if strings.HasPrefix(base, "http://") || strings.HasPrefix(base, "https://") {
+		return strings.TrimSuffix(base, "/")
+	}
+	return "https://" + strings.TrimSuffix(base, "/")
+}
+
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ForgotPassword emails a reset link. It answers the same way whether or not
+// the email is registered, so it can't be used to discover accounts.
+func ForgotPassword(c echo.Context) error {
+	var req ForgotPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	email := strings.TrimSpace(req.Email)
+	if email == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+
+	// one email per address per resetThrottle, silently
+	first, err := cache.Default().SetNX("reset-throttle:"+strings.ToLower(email), "1", resetThrottle)
+	if err != nil || !first {
+		return c.JSON(http.StatusOK, map[string]string{"message": forgotPasswordText})
+	}
+
+	user, err := GetUserByEmail(email)
+	if err != nil {
+		return c.JSON(http.StatusOK, map[string]string{"message": forgotPasswordText})
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		log.Println("Error generating reset token:", err)
+		return c.JSON(http.StatusOK, map[string]string{"message": forgotPasswordText})
+	}
+	reset := PasswordReset{
+		TokenHash: hashToken(token),
+		UUID:      user.UUID,
+		ExpiresAt: time.Now().Add(resetTokenTTL),
+	}
+	_, err = database.DB_Main.Collection("password_resets").InsertOne(c.Request().Context(), reset)
+	if err != nil {
+		log.Println("Error saving reset token:", err)
+		return c.JSON(http.StatusOK, map[string]string{"message": forgotPasswordText})
+	}
+
+	link := SiteURL() + "/reset-password?token=" + token
+	body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your Blogr account. "+
+		"If that was you, open the link below within the next hour:\n\n%s\n\n"+
+		"If you didn't ask for this, you can ignore this email.", user.Username, link)
+	mail.AddMailToQueue(user.Email, "Reset your Blogr password", body)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": forgotPasswordText})
+}
+
+// ResetPassword sets a new password using an emailed token and signs the
+// user out everywhere.
+func ResetPassword(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	if req.Token == "" || len(req.Password) < minPasswordLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Password must be at least " + strconv.Itoa(minPasswordLength) + " characters"})
+	}
+	ctx := c.Request().Context()
+
+	// claim the token atomically so it can only be used once
+	var reset PasswordReset
+	filter := bson.M{"token_hash": hashToken(req.Token), "used": false, "expires_at": bson.M{"$gt": time.Now()}}
+	err := database.DB_Main.Collection("password_resets").FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"used": true}}).Decode(&reset)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired token"})
+	}
+
+	if err := SetPassword(ctx, reset.UUID, req.Password); err != nil {
+		log.Println("Error resetting password:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	// any other outstanding links for this account are void now
+	_, err = database.DB_Main.Collection("password_resets").DeleteMany(ctx, bson.M{"uuid": reset.UUID, "used": false})
+	if err != nil {
+		log.Println("Error deleting reset tokens:", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Password updated"})
+}
+
+// SetPassword rehashes and stores a user's password and revokes their sessions.
+func SetPassword(ctx context.Context, uuid string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = database.DB_Users.Collection(uuid).UpdateOne(ctx, bson.M{"uuid": uuid}, bson.M{"$set": bson.M{"password": hash}})
+	if err != nil {
+		return err
+	}
+	return RevokeSessions(uuid)
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Roles are stored in User.GroupID.
+const (
+	RoleUser      uint = 1
+	RolePremium   uint = 2
+	RoleModerator uint = 3
+	RoleAdmin     uint = 4
+)
+
+// Permissions. ":own" permissions cover the user's own posts and comments,
+// ":any" ones everybody's.
+const (
+	PermPostsCreate       = "posts:create"
+	PermPostsEditOwn      = "posts:edit:own"
+	PermPostsDeleteOwn    = "posts:delete:own"
+	PermPostsCustomCSS    = "posts:css"
+	PermPostsDeleteAny    = "posts:delete:any"
+	PermCommentsCreate    = "comments:create"
+	PermCommentsDeleteAny = "comments:delete:any"
+	PermCommentsModerate  = "comments:moderate:any"
+	PermUsersManage       = "users:manage"
+	PermSiteManage        = "site:manage"
+)
+
+var roleNames = map[uint]string{
+	RoleUser:      "user",
+	RolePremium:   "premium",
+	RoleModerator: "moderator",
+	RoleAdmin:     "admin",
+}
+
+// permissions lists what each role may do. Every role also has the
+// permissions of the roles below it.
+var permissions = map[uint][]string{
+	RoleUser:      {PermPostsCreate, PermPostsEditOwn, PermPostsDeleteOwn, PermCommentsCreate},
+	RolePremium:   {PermPostsCustomCSS},
+	RoleModerator: {PermPostsDeleteAny, PermCommentsDeleteAny, PermCommentsModerate},
+	RoleAdmin:     {PermUsersManage, PermSiteManage},
+}
+
+// RoleName returns the name of a role, e.g. "moderator".
+func RoleName(role uint) string {
+	if name, ok := roleNames[role]; ok {
+		return name
+	}
+	return roleNames[RoleUser]
+}
+
+// ValidRole reports whether role is one of the defined roles.
+func ValidRole(role uint) bool {
+	_, ok := roleNames[role]
+	return ok
+}
+
+// PremiumActive reports whether the user has paid premium that hasn't expired.
+func (u User) PremiumActive() bool {
+	if !u.Premium {
+		return false
+	}
+	if u.PremiumExpiry == "" {
+		return true
+	}
+	expiry, err := time.Parse(time.RFC3339, u.PremiumExpiry)
+	return err == nil && time.Now().Before(expiry)
+}
+
+// Role is the user's effective role. Accounts from before roles existed have
+// no GroupID and count as users; users with active premium count as premium.
+func (u User) Role() uint {
+	role := u.GroupID
+	if !ValidRole(role) {
+		role = RoleUser
+	}
+	if role == RoleUser && u.PremiumActive() {
+		role = RolePremium
+	}
+	return role
+}
+
+// Can reports whether the user has a permission.
+func (u User) Can(permission string) bool {
+	if u.UUID == "" {
+		return false
+	}
+	return roleCan(u.Role(), permission)
+}
+
+func roleCan(role uint, permission string) bool {
+	for r := RoleUser; r <= role; r++ {
+		for _, p := range permissions[r] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Require is a middleware that only lets through logged in users with the permission.
+func Require(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := GetUserFromContext(c)
+			if user.UUID == "" {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			}
+			if !user.Can(permission) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Forbidden"})
+			}
+			return next(c)
+		}
+	}
+}
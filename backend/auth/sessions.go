@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/utils/cache"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	sessionCookie        = "session"
+	sessionMaxAge        = 86400
+	sessionTouchInterval = time.Minute
+)
+
+// Session is kept server side in the cache; the cookie only carries its ID.
+// Each user also has a set of their session IDs so they can be listed and
+// revoked together.
+type Session struct {
+	ID        string    `json:"-"`
+	UUID      string    `json:"uuid"`
+	Pending   bool      `json:"pending,omitempty"` // passed the password check, waiting for a two-factor code
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// SessionInfo is a session as shown to its owner. ID is a hash of the real
+// session ID, which is never sent back to the browser.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+}
+
+func sessionKey(id string) string {
+	return "session:" + id
+}
+
+func userSessionsKey(uuid string) string {
+	return "user-sessions:" + uuid
+}
+
+func (s *Session) handle() string {
+	return hashToken(s.ID)[:16]
+}
+
+// ttl is how long the session has left; sessions don't outlive their cookie.
+func (s *Session) ttl() time.Duration {
+	return time.Until(s.CreatedAt.Add(time.Duration(sessionMaxAge) * time.Second))
+}
+
+func saveSession(s *Session) error {
+	value, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := cache.Default().Set(sessionKey(s.ID), string(value), s.ttl()); err != nil {
+		return err
+	}
+	return cache.Default().SAdd(userSessionsKey(s.UUID), s.ID, time.Duration(sessionMaxAge)*time.Second)
+}
+
+func loadSession(id string) (*Session, error) {
+	value, err := cache.Default().Get(sessionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	if err := json.Unmarshal([]byte(value), s); err != nil {
+		return nil, err
+	}
+	s.ID = id
+	return s, nil
+}
+
+func deleteSession(s *Session) error {
+	if err := cache.Default().Delete(sessionKey(s.ID)); err != nil {
+		return err
+	}
+	return cache.Default().SRem(userSessionsKey(s.UUID), s.ID)
+}
+
+func setSessionCookie(c echo.Context, value string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Domain:   os.Getenv("BASE_URL"),
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// currentSession returns the session of this request, or nil. It also
+// refreshes LastSeen, at most once per sessionTouchInterval.
+func currentSession(c echo.Context) *Session {
+	if s, ok := c.Get("session").(*Session); ok {
+		return s
+	}
+	cookie, err := c.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	s, err := loadSession(cookie.Value)
+	if err != nil {
+		if err != cache.ErrNotFound {
+			log.Println("Error loading session:", err)
+		}
+		return nil
+	}
+	if time.Since(s.LastSeen) > sessionTouchInterval {
+		s.LastSeen = time.Now()
+		s.IP = c.RealIP()
+		if err := saveSession(s); err != nil {
+			log.Println("Error saving session:", err)
+		}
+	}
+	c.Set("session", s)
+	return s
+}
+
+// createSession replaces the request's session with a new one for uuid. A new
+// ID is issued on every login so an earlier cookie can't be fixated.
+func createSession(c echo.Context, uuid string, pending bool) (*Session, error) {
+	if old := currentSession(c); old != nil {
+		if err := deleteSession(old); err != nil {
+			log.Println("Error deleting session:", err)
+		}
+	}
+	id, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		ID:        id,
+		UUID:      uuid,
+		Pending:   pending,
+		CreatedAt: time.Now(),
+		LastSeen:  time.Now(),
+		IP:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+	if err := saveSession(s); err != nil {
+		return nil, err
+	}
+	setSessionCookie(c, id, sessionMaxAge)
+	c.Set("session", s)
+	c.Set("user", nil)
+	return s, nil
+}
+
+// startSession logs the user in on this request.
+func startSession(c echo.Context, userDoc *User) error {
+	_, err := createSession(c, userDoc.UUID, false)
+	return err
+}
+
+// getSessions returns every live session of a user, dropping IDs whose
+// session has already expired from the user's set.
+func getSessions(uuid string) ([]*Session, error) {
+	ids, err := cache.Default().SMembers(userSessionsKey(uuid))
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	for _, id := range ids {
+		s, err := loadSession(id)
+		if err != nil {
+			cache.Default().SRem(userSessionsKey(uuid), id)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// RevokeSessions logs a user out everywhere.
+func RevokeSessions(uuid string) error {
+	ids, err := cache.Default().SMembers(userSessionsKey(uuid))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := cache.Default().Delete(sessionKey(id)); err != nil {
+			return err
+		}
+	}
+	return cache.Default().Delete(userSessionsKey(uuid))
+}
+
+// describeDevice turns a user agent into something like "Firefox on Linux".
+func describeDevice(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "opr/") || strings.Contains(ua, "opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "firefox"):
+		browser = "Firefox"
+	case strings.Contains(ua, "chrome") || strings.Contains(ua, "crios"):
+		browser = "Chrome"
+	case strings.Contains(ua, "safari"):
+		browser = "Safari"
+	case strings.Contains(ua, "curl"):
+		browser = "curl"
+	}
+	system := "unknown system"
+	switch {
+	case strings.Contains(ua, "android"):
+		system = "Android"
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad"):
+		system = "iOS"
+	case strings.Contains(ua, "windows"):
+		system = "Windows"
+	case strings.Contains(ua, "mac os"):
+		system = "macOS"
+	case strings.Contains(ua, "linux"):
+		system = "Linux"
+	}
+	return browser + " on " + system
+}
+
+// UserSessions returns a user's active sessions, newest activity first.
+// currentID marks the session making the request, if any.
+func UserSessions(uuid string, currentID string) ([]SessionInfo, error) {
+	sessions, err := getSessions(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []SessionInfo{}
+	for _, s := range sessions {
+		if s.Pending {
+			continue
+		}
+		infos = append(infos, SessionInfo{
+			ID:        s.handle(),
+			Device:    describeDevice(s.UserAgent),
+			IP:        s.IP,
+			CreatedAt: s.CreatedAt,
+			LastSeen:  s.LastSeen,
+			Current:   s.ID == currentID,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].LastSeen.After(infos[j].LastSeen) })
+	return infos, nil
+}
+
+// ListSessions returns the logged in user's active sessions, newest activity first.
+func ListSessions(c echo.Context) error {
+	current := currentSession(c)
+	if current == nil || current.Pending {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	infos, err := UserSessions(current.UUID, current.ID)
+	if err != nil {
+		log.Println("Error listing sessions:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, infos)
+}
+
+// RevokeSession logs out one of the user's sessions by its listed ID.
+func RevokeSession(c echo.Context) error {
+	current := currentSession(c)
+	if current == nil || current.Pending {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	sessions, err := getSessions(current.UUID)
+	if err != nil {
+		log.Println("Error listing sessions:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	for _, s := range sessions {
+		if s.handle() != c.Param("id") {
+			continue
+		}
+		if err := deleteSession(s); err != nil {
+			log.Println("Error deleting session:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Session revoked"})
+	}
+
+	return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+}
+
+// RevokeOtherSessions logs out every session of the user except this one.
+func RevokeOtherSessions(c echo.Context) error {
+	current := currentSession(c)
+	if current == nil || current.Pending {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	sessions, err := getSessions(current.UUID)
+	if err != nil {
+		log.Println("Error listing sessions:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	for _, s := range sessions {
+		if s.ID == current.ID {
+			continue
+		}
+		if err := deleteSession(s); err != nil {
+			log.Println("Error deleting session:", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Other sessions revoked"})
+}
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/utils/mail"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+
+type ProfileRequest struct {
+	Avatar string `json:"avatar" form:"avatar"`
+	Theme  string `json:"theme" form:"theme"`
+}
+
+type EmailChangeRequest struct {
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password" form:"current_password"`
+	NewPassword     string `json:"new_password" form:"new_password"`
+}
+
+// UsernameRedirect points an old username at the account that used it, so
+// links to /u/<old>/... keep working after a rename.
+type UsernameRedirect struct {
+	Username string    `bson:"_id"`
+	UUID     string    `bson:"uuid"`
+	Date     time.Time `bson:"date"`
+}
+
+func usernameRedirects() *mongo.Collection {
+	return database.DB_Main.Collection("username_redirects")
+}
+
+// Reauthenticate returns the logged in user if password is theirs. Otherwise
+// it returns the status and message to respond with. Wrong passwords count
+// towards the login lockout, so a stolen session can't be used to guess one.
+func Reauthenticate(c echo.Context, password string) (User, int, string) {
+	user := GetUserFromContext(c)
+	if user.Email == "" {
+		return User{}, http.StatusUnauthorized, "Unauthorized"
+	}
+	email := NormalizeEmail(user.Email)
+	if wait := loginBlocked(email, c.RealIP()); wait > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		return User{}, http.StatusTooManyRequests, "Too many failed attempts, try again later"
+	}
+	if !checkPassword(password, user.Password) {
+		recordLoginFailure(c, email, &user)
+		return User{}, http.StatusUnauthorized, "Incorrect password"
+	}
+	clearLoginFailures(email)
+	return user, http.StatusOK, ""
+}
+
+// ValidUsername reports whether a username may be used in /u/ URLs.
+func ValidUsername(username string) bool {
+	return usernamePattern.MatchString(username)
+}
+
+func exactMatch(value string) bson.M {
+	return bson.M{"$regex": "^" + regexp.QuoteMeta(value) + "$", "$options": "i"}
+}
+
+// UsernameTaken reports whether username, ignoring case, belongs to another
+// account or still redirects to one.
+func UsernameTaken(ctx context.Context, username string, uuid string) (bool, error) {
+	var entry UserList
+	err := database.DB_UserList.Collection("users").FindOne(ctx, bson.M{"username": exactMatch(username)}).Decode(&entry)
+	if err == nil {
+		return entry.UUID != uuid, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return false, err
+	}
+
+	var redirect UsernameRedirect
+	err = usernameRedirects().FindOne(ctx, bson.M{"_id": strings.ToLower(username)}).Decode(&redirect)
+	if err == nil {
+		return redirect.UUID != uuid, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return false, err
+	}
+	return false, nil
+}
+
+// EmailTaken reports whether another account uses email.
+func EmailTaken(ctx context.Context, email string, uuid string) (bool, error) {
+	var entry UserList
+	err := database.DB_UserList.Collection("users").FindOne(ctx, bson.M{"email": exactMatch(email)}).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return entry.UUID != uuid, nil
+}
+
+// SetUsername renames an account in its user document and in DB_UserList,
+// and keeps a redirect from the old name. Posts and comments are updated by
+// the caller.
+func SetUsername(ctx context.Context, user User, username string) error {
+	_, err := database.DB_Users.Collection(user.UUID).UpdateOne(ctx, bson.M{"uuid": user.UUID}, bson.M{"$set": bson.M{"username": username}})
+	if err != nil {
+		return err
+	}
+	_, err = database.DB_UserList.Collection("users").UpdateOne(ctx, bson.M{"uuid": user.UUID}, bson.M{"$set": bson.M{"username": username}})
+	if err != nil {
+		return err
+	}
+
+	redirect := UsernameRedirect{Username: strings.ToLower(user.Username), UUID: user.UUID, Date: time.Now()}
+	_, err = usernameRedirects().ReplaceOne(ctx, bson.M{"_id": redirect.Username}, redirect, options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	// taking an old name back shouldn't redirect it to itself
+	_, err = usernameRedirects().DeleteOne(ctx, bson.M{"_id": strings.ToLower(username)})
+	return err
+}
+
+// RenamedUser returns the current account of a username that has since been
+// changed.
+func RenamedUser(ctx context.Context, username string) (User, error) {
+	var redirect UsernameRedirect
+	err := usernameRedirects().FindOne(ctx, bson.M{"_id": strings.ToLower(username)}).Decode(&redirect)
+	if err != nil {
+		return User{}, err
+	}
+	return GetUserByUUID(redirect.UUID)
+}
+
+// ChangeEmail moves the account to a new email, which has to be verified again.
+func ChangeEmail(c echo.Context) error {
+	var req EmailChangeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	user, status, msg := Reauthenticate(c, req.Password)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	email := NormalizeEmail(req.Email)
+	if email == "" || !strings.Contains(email, "@") || len(email) > 254 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid email"})
+	}
+	if strings.EqualFold(email, user.Email) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "That is already your email"})
+	}
+	ctx := c.Request().Context()
+
+	taken, err := EmailTaken(ctx, email, user.UUID)
+	if err != nil {
+		log.Println("Error checking email:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if taken {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "That email is already in use"})
+	}
+
+	update := bson.M{"$set": bson.M{"email": email, "verifiedemail": false}}
+	if _, err := database.DB_Users.Collection(user.UUID).UpdateOne(ctx, bson.M{"uuid": user.UUID}, update); err != nil {
+		log.Println("Error updating email:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	_, err = database.DB_UserList.Collection("users").UpdateOne(ctx, bson.M{"uuid": user.UUID}, bson.M{"$set": bson.M{"email": email}})
+	if mongo.IsDuplicateKeyError(err) {
+		// someone took the email since EmailTaken; put the old one back
+		restore := bson.M{"$set": bson.M{"email": user.Email, "verifiedemail": user.VerifiedEmail}}
+		if _, err := database.DB_Users.Collection(user.UUID).UpdateOne(ctx, bson.M{"uuid": user.UUID}, restore); err != nil {
+			log.Println("Error restoring email:", err)
+		}
+		return c.JSON(http.StatusConflict, map[string]string{"error": "That email is already in use"})
+	}
+	if err != nil {
+		log.Println("Error updating email:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	oldEmail := user.Email
+	user.Email = email
+	user.VerifiedEmail = false
+	SendVerificationEmail(user)
+	mail.AddMailToQueue(oldEmail, "Your Blogr email was changed", fmt.Sprintf("Hi %s,\n\nThe email of your Blogr account was changed to %s. "+
+		"If you didn't do this, reset your password at %s and contact us.", user.Username, email, SiteURL()+"/forgot-password"))
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Email updated, check your inbox to verify it"})
+}
+
+// ChangePassword sets a new password after checking the current one. Every
+// other session is logged out; this one is started again.
+func ChangePassword(c echo.Context) error {
+	var req PasswordChangeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	user, status, msg := Reauthenticate(c, req.CurrentPassword)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Password must be at least " + strconv.Itoa(minPasswordLength) + " characters"})
+	}
+
+	if err := SetPassword(c.Request().Context(), user.UUID, req.NewPassword); err != nil {
+		log.Println("Error changing password:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	// SetPassword revoked this session along with the others
+	c.Set("session", nil)
+	if err := startSession(c, &user); err != nil {
+		log.Println("Error saving session:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Password updated"})
+}
@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/database"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scopes a personal access token can be granted.
+const (
+	ScopePostsRead     = "posts:read"
+	ScopePostsWrite    = "posts:write"
+	ScopeAnalyticsRead = "analytics:read"
+)
+
+var (
+	tokenPrefix        = "blogr_"
+	maxTokensPerUser   = 20
+	tokenTouchInterval = time.Minute
+)
+
+// APIToken is a personal access token. Like reset tokens only the hash is
+// stored; the token itself is shown once, when it is created.
+type APIToken struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UUID       string             `bson:"uuid" json:"-"`
+	Name       string             `bson:"name" json:"name"`
+	TokenHash  string             `bson:"token_hash" json:"-"`
+	Hint       string             `bson:"hint" json:"hint"`
+	Scopes     []string           `bson:"scopes" json:"scopes"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+type APITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+func apiTokens() *mongo.Collection {
+	return database.DB_Main.Collection("api_tokens")
+}
+
+func validScope(scope string) bool {
+	switch scope {
+	case ScopePostsRead, ScopePostsWrite, ScopeAnalyticsRead:
+		return true
+	}
+	return false
+}
+
+func (t *APIToken) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenScope lets a route be called with a personal access token that has the
+// scope. Routes without it only accept the browser session.
+func TokenScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("token_scope", scope)
+			return next(c)
+		}
+	}
+}
+
+// BearerToken returns the API token in the Authorization header, if any.
+func BearerToken(c echo.Context) string {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// userFromToken authenticates a bearer token for the route's scope and
+// records when the token was last used.
+func userFromToken(c echo.Context, token string) (User, bool) {
+	scope, _ := c.Get("token_scope").(string)
+	if scope == "" {
+		return User{}, false
+	}
+	ctx := c.Request().Context()
+
+	var t APIToken
+	err := apiTokens().FindOne(ctx, bson.M{"token_hash": hashToken(token)}).Decode(&t)
+	if err != nil {
+		return User{}, false
+	}
+	if t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt) {
+		return User{}, false
+	}
+	if !t.hasScope(scope) {
+		return User{}, false
+	}
+
+	now := time.Now()
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > tokenTouchInterval {
+		_, err := apiTokens().UpdateOne(ctx, bson.M{"_id": t.ID}, bson.M{"$set": bson.M{"last_used_at": now}})
+		if err != nil {
+			log.Println("Error updating token:", err)
+		}
+	}
+
+	user, err := GetUserByUUID(t.UUID)
+	if err != nil || user.Suspended {
+		return User{}, false
+	}
+	return user, true
+}
+
+// ListTokens returns the logged in user's tokens, without their secrets.
+func ListTokens(c echo.Context) error {
+	user := GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	tokens, err := UserTokens(c.Request().Context(), user.UUID)
+	if err != nil {
+		log.Println("Error listing tokens:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// UserTokens returns a user's tokens, newest first. Only hashes of the
+// secrets are stored, and those aren't serialised.
+func UserTokens(ctx context.Context, uuid string) ([]APIToken, error) {
+	cursor, err := apiTokens().Find(ctx, bson.M{"uuid": uuid}, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, err
+	}
+	tokens := []APIToken{}
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CreateToken issues a new token. The response is the only time it is shown.
+func CreateToken(c echo.Context) error {
+	user := GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	var req APITokenRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name is required"})
+	}
+	if len(req.Scopes) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "At least one scope is required"})
+	}
+	for _, scope := range req.Scopes {
+		if !validScope(scope) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid scope " + scope})
+		}
+	}
+	if req.ExpiresInDays < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid expiry"})
+	}
+	ctx := c.Request().Context()
+
+	count, err := apiTokens().CountDocuments(ctx, bson.M{"uuid": user.UUID})
+	if err != nil {
+		log.Println("Error counting tokens:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if count >= int64(maxTokensPerUser) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Too many tokens, revoke one first"})
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		log.Println("Error generating token:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	token := tokenPrefix + secret
+	t := APIToken{
+		UUID:      user.UUID,
+		Name:      req.Name,
+		TokenHash: hashToken(token),
+		Hint:      token[len(token)-4:],
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now(),
+	}
+	if req.ExpiresInDays > 0 {
+		expires := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		t.ExpiresAt = &expires
+	}
+	result, err := apiTokens().InsertOne(ctx, t)
+	if err != nil {
+		log.Println("Error saving token:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	t.ID = result.InsertedID.(primitive.ObjectID)
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{"token": token, "details": t})
+}
+
+// RevokeToken deletes one of the logged in user's tokens.
+func RevokeToken(c echo.Context) error {
+	user := GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid token ID"})
+	}
+
+	result, err := apiTokens().DeleteOne(c.Request().Context(), bson.M{"_id": id, "uuid": user.UUID})
+	if err != nil {
+		log.Println("Error deleting token:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if result.DeletedCount == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Token not found"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Token revoked"})
+}
@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/utils/cache"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RFC 6238 defaults, which is what authenticator apps expect.
+var (
+	totpIssuer        = "Blogr"
+	totpPeriod        = int64(30)
+	totpDigits        = 6
+	totpSkew          = int64(1)
+	recoveryCodeCount = 10
+	twoFactorTTL      = 5 * time.Minute
+	twoFactorAttempts = int64(5)
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TwoFactorRequest struct {
+	Code     string `json:"code" form:"code"`
+	Password string `json:"password" form:"password"`
+}
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b32.EncodeToString(b), nil
+}
+
+// totpCode computes the code for one time step (RFC 4226 section 5.3).
+func totpCode(secret string, step int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// validateTOTP checks a code against the current time step and totpSkew steps
+// either side, and returns the step that matched.
+func validateTOTP(secret string, code string) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// useTOTP validates a code and makes sure it isn't replayed within its window.
+func useTOTP(uuid string, secret string, code string) bool {
+	step, ok := validateTOTP(secret, code)
+	if !ok {
+		return false
+	}
+	ttl := time.Duration(totpPeriod*(2*totpSkew+1)) * time.Second
+	first, err := cache.Default().SetNX("totp-used:"+uuid+":"+strconv.FormatInt(step, 10), "1", ttl)
+	return err == nil && first
+}
+
+func provisioningURI(secret string, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("digits", strconv.Itoa(totpDigits))
+	v.Set("period", strconv.FormatInt(totpPeriod, 10))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+account) + "?" + v.Encode()
+}
+
+// generateRecoveryCodes returns new codes to show the user and their hashes to store.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode puts a code the way the user typed it, e.g. without
+// the hyphen, with spaces or in capitals, back in the form it was hashed in.
+func normalizeRecoveryCode(code string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(code) {
+		if (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') {
+			b.WriteRune(r)
+		}
+	}
+	digits := b.String()
+	if len(digits) != 10 {
+		return digits
+	}
+	return digits[:5] + "-" + digits[5:]
+}
+
+// useRecoveryCode removes a matching recovery code from the user. The pull is
+// atomic, so a code can only be used once.
+func useRecoveryCode(c echo.Context, uuid string, code string) bool {
+	hash := hashToken(normalizeRecoveryCode(code))
+	result, err := database.DB_Users.Collection(uuid).UpdateOne(c.Request().Context(),
+		bson.M{"uuid": uuid, "recoverycodes": hash},
+		bson.M{"$pull": bson.M{"recoverycodes": hash}})
+	return err == nil && result.ModifiedCount == 1
+}
+
+// SetupTwoFactor starts enrollment. The secret stays pending until a code from
+// it is confirmed, so a half finished setup can't lock the user out.
+func SetupTwoFactor(c echo.Context) error {
+	var req TwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	user, status, msg := Reauthenticate(c, req.Password)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	if user.TOTPEnabled {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Two-factor authentication is already enabled"})
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Println("Error generating TOTP secret:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	_, err = database.DB_Users.Collection(user.UUID).UpdateOne(c.Request().Context(), bson.M{"uuid": user.UUID}, bson.M{"$set": bson.M{"totppending": secret}})
+	if err != nil {
+		log.Println("Error saving TOTP secret:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"secret": secret,
+		"uri":    provisioningURI(secret, user.Email),
+	})
+}
+
+// ConfirmTwoFactor enables two-factor authentication once the user proves
+// their app produces valid codes, and returns the first set of recovery codes.
+func ConfirmTwoFactor(c echo.Context) error {
+	var req TwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	user := GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if user.TOTPPending == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Two-factor setup has not been started"})
+	}
+	if !useTOTP(user.UUID, user.TOTPPending, req.Code) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid code"})
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Println("Error generating recovery codes:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	update := bson.M{
+		"$set":   bson.M{"totpsecret": user.TOTPPending, "totpenabled": true, "recoverycodes": hashes},
+		"$unset": bson.M{"totppending": ""},
+	}
+	_, err = database.DB_Users.Collection(user.UUID).UpdateOne(c.Request().Context(), bson.M{"uuid": user.UUID}, update)
+	if err != nil {
+		log.Println("Error enabling two-factor:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTwoFactor turns two-factor authentication off after a password check.
+func DisableTwoFactor(c echo.Context) error {
+	var req TwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	user, status, msg := Reauthenticate(c, req.Password)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+
+	update := bson.M{
+		"$set":   bson.M{"totpenabled": false},
+		"$unset": bson.M{"totpsecret": "", "totppending": "", "recoverycodes": ""},
+	}
+	_, err := database.DB_Users.Collection(user.UUID).UpdateOne(c.Request().Context(), bson.M{"uuid": user.UUID}, update)
+	if err != nil {
+		log.Println("Error disabling two-factor:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after a password check.
+func RegenerateRecoveryCodes(c echo.Context) error {
+	var req TwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	user, status, msg := Reauthenticate(c, req.Password)
+	if status != http.StatusOK {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	if !user.TOTPEnabled {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Two-factor authentication is not enabled"})
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Println("Error generating recovery codes:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	_, err = database.DB_Users.Collection(user.UUID).UpdateOne(c.Request().Context(), bson.M{"uuid": user.UUID}, bson.M{"$set": bson.M{"recoverycodes": hashes}})
+	if err != nil {
+		log.Println("Error saving recovery codes:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// LoginTwoFactor is the second login step. Login leaves a pending session for a
+// user who passed the password check; a TOTP or recovery code finishes it.
+func LoginTwoFactor(c echo.Context) error {
+	var req TwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+
+	pending := currentSession(c)
+	if pending == nil || !pending.Pending || time.Since(pending.CreatedAt) > twoFactorTTL {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Login expired, please sign in again"})
+	}
+	uuid := pending.UUID
+
+	attempts, err := cache.Default().Incr("2fa-attempts:"+uuid, twoFactorTTL)
+	if err != nil || attempts > twoFactorAttempts {
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many attempts, please sign in again later"})
+	}
+
+	user, err := GetUserByUUID(uuid)
+	if err != nil {
+		log.Println("Error finding user:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if !useTOTP(user.UUID, user.TOTPSecret, req.Code) && !useRecoveryCode(c, user.UUID, req.Code) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid code"})
+	}
+
+	cache.Default().Delete("2fa-attempts:" + uuid)
+	if err := startSession(c, &user); err != nil {
+		log.Println("Error saving session:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Logged in"})
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors from RFC 6238 appendix B.
+func TestTOTPCode(t *testing.T) {
+	defer func(digits int) { totpDigits = digits }(totpDigits)
+	totpDigits = 8
+	secret := b32.EncodeToString([]byte("12345678901234567890"))
+
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		code, err := totpCode(secret, tc.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("at %d got %s, want %s", tc.unix, code, tc.code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only steps that stay in the window if the clock ticks over mid-test
+	now := time.Now().Unix() / totpPeriod
+	for _, step := range []int64{now, now + totpSkew} {
+		code, err := totpCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := validateTOTP(secret, code[:3]+" "+code[3:]); !ok || got != step {
+			t.Errorf("code for step %d: got %d, %v", step, got, ok)
+		}
+	}
+	code, err := totpCode(secret, now+2*totpSkew+2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := validateTOTP(secret, code); ok {
+		t.Error("accepted a code from outside the window")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	for _, typed := range []string{"a1b2c-3d4e5", "A1B2C-3D4E5", "a1b2c3d4e5", " a1b2c 3d4e5 "} {
+		if got := normalizeRecoveryCode(typed); got != "a1b2c-3d4e5" {
+			t.Errorf("%q: got %q", typed, got)
+		}
+	}
+}
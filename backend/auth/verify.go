@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/utils/cache"
+	"blogr.moe/backend/utils/mail"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	verifyTokenTTL = 48 * time.Hour
+	verifyThrottle = 5 * time.Minute
+)
+
+var errInvalidVerifyToken = errors.New("invalid or expired verification link")
+
+// RequireVerifiedEmail reports whether users must verify their email before
+// publishing. Operators turn it on with REQUIRE_VERIFIED_EMAIL=true.
+func RequireVerifiedEmail() bool {
+	require, _ := strconv.ParseBool(os.Getenv("REQUIRE_VERIFIED_EMAIL"))
+	return require
+}
+
+func verifySignature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("SECRET")))
+	mac.Write([]byte("verify-email|" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signVerifyToken builds a stateless token for uuid and email. The email is
+// part of the signed payload so a link stops working once the email changes.
+func signVerifyToken(uuid string, email string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(uuid + "|" + email + "|" + strconv.FormatInt(expires.Unix(), 10)))
+	return payload + "." + verifySignature(payload)
+}
+
+func parseVerifyToken(token string) (string, string, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(verifySignature(payload))) {
+		return "", "", errInvalidVerifyToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", errInvalidVerifyToken
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return "", "", errInvalidVerifyToken
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", "", errInvalidVerifyToken
+	}
+	return parts[0], parts[1], nil
+}
+
+// SendVerificationEmail queues an email with a signed verification link.
+func SendVerificationEmail(user User) {
+	token := signVerifyToken(user.UUID, user.Email, time.Now().Add(verifyTokenTTL))
+	link := SiteURL() + "/verify-email?token=" + token
+	body := fmt.Sprintf("Hi %s,\n\nPlease confirm the email address of your Blogr account by opening the link below "+
+		"within the next two days:\n\n%s\n\nIf you didn't create an account, you can ignore this email.", user.Username, link)
+	mail.AddMailToQueue(user.Email, "Verify your Blogr email", body)
+}
+
+// VerifyEmail marks the email in a verification link as verified.
+func VerifyEmail(c echo.Context) error {
+	uuid, email, err := parseVerifyToken(c.QueryParam("token"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired verification link"})
+	}
+
+	filter := bson.M{"uuid": uuid, "email": email}
+	result, err := database.DB_Users.Collection(uuid).UpdateOne(c.Request().Context(), filter, bson.M{"$set": bson.M{"verifiedemail": true}})
+	if err != nil {
+		log.Println("Error updating user:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if result.MatchedCount == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid or expired verification link"})
+	}
+
+	return c.Redirect(http.StatusFound, "/dashboard?verified=1")
+}
+
+// ResendVerification sends the logged in user a new verification link, at most
+// once per verifyThrottle.
+func ResendVerification(c echo.Context) error {
+	user := GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if user.VerifiedEmail {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email is already verified"})
+	}
+
+	first, err := cache.Default().SetNX("verify-throttle:"+user.UUID, "1", verifyThrottle)
+	if err != nil {
+		log.Println("Error throttling verification email:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	if !first {
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "A verification email was sent recently, please wait a few minutes"})
+	}
+
+	SendVerificationEmail(user)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Verification email sent"})
+}
+
+// IsEmailVerified reports whether the user with uuid has verified their email.
+func IsEmailVerified(uuid string) bool {
+	user, err := GetUserByUUID(uuid)
+	if err != nil {
+		return false
+	}
+	return user.VerifiedEmail
+}
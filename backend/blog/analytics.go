@@ -0,0 +1,312 @@
+package blog
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	analyticsDays    = 30
+	analyticsMaxDays = 365
+	analyticsTop     = 10
+	// referrers past this many in one day's bucket are counted as "other"
+	analyticsMaxReferrers = 100
+)
+
+// DailyStats is one post's views on one day. Referrer domains are stored with
+// their dots escaped because MongoDB field names can't contain them.
+type DailyStats struct {
+	ID        string         `bson:"_id" json:"-"`
+	Author    string         `bson:"author" json:"author"`
+	BlogID    string         `bson:"blog_id" json:"blog_id"`
+	Day       string         `bson:"day" json:"day"`
+	Views     int            `bson:"views" json:"views"`
+	Referrers map[string]int `bson:"referrers" json:"referrers"`
+	Devices   map[string]int `bson:"devices" json:"devices"`
+}
+
+type DayViews struct {
+	Day   string `json:"day"`
+	Views int    `json:"views"`
+}
+
+type PostViews struct {
+	BlogID string `json:"blog_id"`
+	Title  string `json:"title"`
+	Views  int    `json:"views"`
+}
+
+type ReferrerViews struct {
+	Domain string `json:"domain"`
+	Views  int    `json:"views"`
+}
+
+type Analytics struct {
+	Since        string          `json:"since"`
+	TotalViews   int             `json:"total_views"`
+	Daily        []DayViews      `json:"daily"`
+	TopPosts     []PostViews     `json:"top_posts"`
+	TopReferrers []ReferrerViews `json:"top_referrers"`
+	Devices      map[string]int  `json:"devices"`
+}
+
+// pendingStats buffers one post's analytics for one day until FlushViews.
+type pendingStats struct {
+	author    string
+	blogID    string
+	day       string
+	views     int
+	referrers map[string]int
+	devices   map[string]int
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = make(map[string]*pendingStats)
+)
+
+func analytics() *mongo.Collection {
+	return database.DB_Main.Collection("analytics")
+}
+
+// referrerDomain reduces the Referer header to a host name. Visits without
+// one are "direct" and visits from our own pages are "internal".
+func referrerDomain(c echo.Context) string {
+	ref := c.Request().Referer()
+	if ref == "" {
+		return "direct"
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Hostname() == "" {
+		return "direct"
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	if host == strings.TrimPrefix(strings.ToLower(c.Request().Host), "www.") {
+		return "internal"
+	}
+	return host
+}
+
+// deviceClass is a coarse guess from the user agent; nothing finer is kept.
+func deviceClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet"):
+		return "tablet"
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone") || strings.Contains(ua, "android"):
+		return "mobile"
+	case strings.Contains(ua, "windows") || strings.Contains(ua, "macintosh") || strings.Contains(ua, "linux") || strings.Contains(ua, "cros"):
+		return "desktop"
+	default:
+		return "other"
+	}
+}
+
+var (
+	fieldEscaper   = strings.NewReplacer("%", "%25", "$", "%24", ".", "%2E")
+	fieldUnescaper = strings.NewReplacer("%2E", ".", "%24", "$", "%25", "%")
+)
+
+func escapeField(s string) string {
+	return fieldEscaper.Replace(s)
+}
+
+func unescapeField(s string) string {
+	return fieldUnescaper.Replace(s)
+}
+
+// recordAnalytics buffers the referrer and device of a counted view.
+func recordAnalytics(c echo.Context, post *BlogPost) {
+	day := time.Now().UTC().Format("2006-01-02")
+	key := post.Author + "/" + post.BlogID + "/" + day
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	pending, ok := stats[key]
+	if !ok {
+		pending = &pendingStats{
+			author:    post.Author,
+			blogID:    post.BlogID,
+			day:       day,
+			referrers: make(map[string]int),
+			devices:   make(map[string]int),
+		}
+		stats[key] = pending
+	}
+	pending.views++
+	domain := escapeField(referrerDomain(c))
+	if _, ok := pending.referrers[domain]; !ok && len(pending.referrers) >= analyticsMaxReferrers {
+		domain = "other"
+	}
+	pending.referrers[domain]++
+	pending.devices[deviceClass(c.Request().UserAgent())]++
+}
+
+// flushAnalytics writes the buffered daily buckets with one upsert per post and day.
+func flushAnalytics(ctx context.Context, authors map[string]auth.User) {
+	statsMu.Lock()
+	batch := stats
+	stats = make(map[string]*pendingStats)
+	statsMu.Unlock()
+
+	for key, pending := range batch {
+		// views from before a rename go to the new name's bucket
+		if author, err := authorNamed(ctx, pending.author, authors); err == nil && author.Username != pending.author {
+			pending.author = author.Username
+			key = pending.author + "/" + pending.blogID + "/" + pending.day
+		}
+
+		// the referrers already in the bucket decide which new ones still fit
+		var existing DailyStats
+		opts := options.FindOne().SetProjection(bson.M{"referrers": 1})
+		err := analytics().FindOne(ctx, bson.M{"_id": key}, opts).Decode(&existing)
+		if err != nil && err != mongo.ErrNoDocuments {
+			logs.Error("Error reading analytics:", err)
+			continue
+		}
+		known := len(existing.Referrers)
+
+		inc := bson.M{"views": pending.views}
+		for domain, n := range pending.referrers {
+			if _, ok := existing.Referrers[domain]; !ok && domain != "other" {
+				if known >= analyticsMaxReferrers {
+					domain = "other"
+				} else {
+					known++
+				}
+			}
+			if prev, ok := inc["referrers."+domain].(int); ok {
+				n += prev
+			}
+			inc["referrers."+domain] = n
+		}
+		for device, n := range pending.devices {
+			inc["devices."+device] = n
+		}
+		update := bson.M{
+			"$inc":         inc,
+			"$setOnInsert": bson.M{"author": pending.author, "blog_id": pending.blogID, "day": pending.day},
+		}
+		_, err = analytics().UpdateOne(ctx, bson.M{"_id": key}, update, options.Update().SetUpsert(true))
+		if err != nil {
+			logs.Error("Error updating analytics:", err)
+		}
+	}
+}
+
+// GetAnalytics summarises the views of an author's posts since the given day.
+func GetAnalytics(ctx context.Context, uuid string, author string, since time.Time) (*Analytics, error) {
+	sinceDay := since.UTC().Format("2006-01-02")
+	filter := bson.M{"author": author, "day": bson.M{"$gte": sinceDay}}
+	cursor, err := analytics().Find(ctx, filter, options.Find().SetSort(bson.M{"day": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var buckets []DailyStats
+	if err := cursor.All(ctx, &buckets); err != nil {
+		return nil, err
+	}
+
+	result := &Analytics{Since: sinceDay, Daily: []DayViews{}, Devices: map[string]int{}}
+	daily := make(map[string]int)
+	posts := make(map[string]int)
+	referrers := make(map[string]int)
+	for _, bucket := range buckets {
+		result.TotalViews += bucket.Views
+		daily[bucket.Day] += bucket.Views
+		posts[bucket.BlogID] += bucket.Views
+		for domain, n := range bucket.Referrers {
+			referrers[unescapeField(domain)] += n
+		}
+		for device, n := range bucket.Devices {
+			result.Devices[device] += n
+		}
+	}
+
+	// every day in the range is listed so charts don't skip days without views
+	for day := since.UTC(); !day.After(time.Now().UTC()); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		result.Daily = append(result.Daily, DayViews{Day: key, Views: daily[key]})
+	}
+
+	result.TopPosts = []PostViews{}
+	for blogID, views := range posts {
+		result.TopPosts = append(result.TopPosts, PostViews{BlogID: blogID, Title: blogID, Views: views})
+	}
+	sort.Slice(result.TopPosts, func(i, j int) bool { return result.TopPosts[i].Views > result.TopPosts[j].Views })
+	if len(result.TopPosts) > analyticsTop {
+		result.TopPosts = result.TopPosts[:analyticsTop]
+	}
+	// the titles of the top posts in one query; deleted posts keep their ID
+	ids := make([]string, len(result.TopPosts))
+	for i, post := range result.TopPosts {
+		ids[i] = post.BlogID
+	}
+	opts := options.Find().SetProjection(bson.M{"blog_id": 1, "title": 1})
+	cursor, err = database.DB_Users.Collection(uuid).Find(ctx, bson.M{"blog_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var titled []BlogPost
+	if err := cursor.All(ctx, &titled); err != nil {
+		return nil, err
+	}
+	titles := make(map[string]string, len(titled))
+	for _, post := range titled {
+		titles[post.BlogID] = post.Title
+	}
+	for i, post := range result.TopPosts {
+		if title, ok := titles[post.BlogID]; ok {
+			result.TopPosts[i].Title = title
+		}
+	}
+
+	result.TopReferrers = []ReferrerViews{}
+	for domain, views := range referrers {
+		result.TopReferrers = append(result.TopReferrers, ReferrerViews{Domain: domain, Views: views})
+	}
+	sort.Slice(result.TopReferrers, func(i, j int) bool { return result.TopReferrers[i].Views > result.TopReferrers[j].Views })
+	if len(result.TopReferrers) > analyticsTop {
+		result.TopReferrers = result.TopReferrers[:analyticsTop]
+	}
+
+	return result, nil
+}
+
+// GetUserAnalytics returns the logged in user's analytics for the last ?days days.
+func GetUserAnalytics(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	days, err := strconv.Atoi(c.QueryParam("days"))
+	if err != nil || days < 1 {
+		days = analyticsDays
+	}
+	if days > analyticsMaxDays {
+		days = analyticsMaxDays
+	}
+	since := time.Now().UTC().AddDate(0, 0, -(days - 1)).Truncate(24 * time.Hour)
+
+	result, err := GetAnalytics(c.Request().Context(), user.UUID, user.Username, since)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching analytics"})
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -2,18 +2,16 @@ package blog
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"net/http"
-	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"blogr.moe/backend/auth"
 	"blogr.moe/backend/database"
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -22,25 +20,37 @@ import (
 )
 
 type BlogPost struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	BlogID   string             `bson:"blog_id" json:"blog_id"`
-	Title    string             `bson:"title" json:"title"`
-	Content  string             `bson:"content" json:"content"`
-	Tags     string             `bson:"tags" json:"tags"`
-	Image    primitive.ObjectID `bson:"image" json:"image"`
-	Date     string             `bson:"date" json:"date"`
-	Author   string             `bson:"author" json:"author"`
-	Comments []Comment          `bson:"comments" json:"comments"`
-	CSS      string             `bson:"css" json:"css"`
-	Views    int                `bson:"views" json:"views"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	BlogID        string             `bson:"blog_id" json:"blog_id"`
+	Title         string             `bson:"title" json:"title"`
+	Content       string             `bson:"content" json:"content"`
+	Tags          []string           `bson:"tags" json:"tags"`
+	Image         primitive.ObjectID `bson:"image" json:"image"`
+	Date          string             `bson:"date" json:"date"`
+	Author        string             `bson:"author" json:"author"`
+	Comments      []Comment          `bson:"comments" json:"comments"`
+	CSS           string             `bson:"css" json:"css"`
+	Views         int                `bson:"views" json:"views"`
+	Updated       string             `bson:"updated,omitempty" json:"updated,omitempty"`
+	Status        string             `bson:"status" json:"status"`
+	PublishAt     string             `bson:"publish_at,omitempty" json:"publish_at,omitempty"`
+	CommentPolicy string             `bson:"comment_policy,omitempty" json:"comment_policy,omitempty"`
 }
 
 type Comment struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Comment  string             `bson:"comment" json:"comment"`
-	BlogID   uuid.UUID          `bson:"blog_id" json:"blog_id"`
-	Username string             `bson:"username" json:"username"`
-	Date     string             `bson:"date" json:"date"`
+	ID         primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
+	Comment    string               `bson:"comment" json:"comment"`
+	BlogID     string               `bson:"blog_id" json:"blog_id"`
+	PostAuthor string               `bson:"post_author" json:"post_author"`
+	ParentID   primitive.ObjectID   `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	Path       []primitive.ObjectID `bson:"path" json:"-"`
+	UserUUID   string               `bson:"user_uuid" json:"-"`
+	Username   string               `bson:"username" json:"username"`
+	Date       string               `bson:"date" json:"date"`
+	Edited     string               `bson:"edited,omitempty" json:"edited,omitempty"`
+	Status     string               `bson:"status" json:"status"`
+	Guest      bool                 `bson:"guest" json:"guest"`
+	Replies    []*Comment           `bson:"-" json:"replies,omitempty"`
 }
 
 type TotalPosts struct {
@@ -65,17 +75,37 @@ func NewBlogHandler(c echo.Context) error {
 
 	blog.Title = c.FormValue("title")
 	blog.Content = c.FormValue("content")
-	tags := c.FormValue("tags")
-	tagsSlice := strings.Split(tags, ",")
-	sort.Strings(tagsSlice)
-	sortedTags := strings.Join(tagsSlice, ",")
-	blog.Tags = strconv.Quote(sortedTags)
+	blog.Tags = NormalizeTags(c.FormValue("tags"))
 	blog.Author = user.Username
 	blog.Date = time.Now().Format(time.RFC3339)
 	blog.Views = 0
 	blog.BlogID = generateRandomString(6)
 	uuid := user.UUID
 
+	status, publishAt, err := parseStatus(c.FormValue("status"), c.FormValue("publish_at"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	if !canPublish(uuid, status) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Verify your email before publishing"})
+	}
+	blog.Status = status
+	blog.PublishAt = publishAt
+
+	if css := c.FormValue("css"); css != "" {
+		if !user.Can(auth.PermPostsCustomCSS) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Custom CSS needs premium"})
+		}
+		blog.CSS = css
+	}
+
+	if policy := c.FormValue("comment_policy"); policy != "" {
+		if !validPolicy(policy) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid comment policy"})
+		}
+		blog.CommentPolicy = policy
+	}
+
 	// Check if the image file is provided
 	image, err := c.FormFile("image")
 	if err != nil {
@@ -104,22 +134,23 @@ func NewBlogHandler(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error creating blog"})
 	}
-	_, err = database.DB_Main.Collection("posts").InsertOne(c.Request().Context(), blog)
-	if err != nil {
+	if err := setSchedule(c.Request().Context(), uuid, blog.BlogID, blog.Status, blog.PublishAt); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error creating blog"})
 	}
+	// drafts, scheduled and unlisted posts are mirrored once they are published
+	if blog.IsPublished() {
+		_, err = database.DB_Main.Collection("posts").InsertOne(c.Request().Context(), blog)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error creating blog"})
+		}
+	}
 
 	return c.JSON(http.StatusCreated, res)
 }
-func GetLatestPostsUser(c echo.Context) error {
-	user := auth.GetUserFromContext(c)
-	if user.Email == "" {
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
-	}
-
-	uuid := user.UUID
 
-	// Extract pagination parameters
+// Paginate reads the page and limit query parameters and returns them with
+// the number of documents to skip.
+func Paginate(c echo.Context) (int, int, int) {
 	page, err := strconv.Atoi(c.QueryParam("page"))
 	if err != nil || page < 1 {
 		page = 1
@@ -129,6 +160,19 @@ func GetLatestPostsUser(c echo.Context) error {
 		limit = 10
 	}
 	skip := (page - 1) * limit
+	return page, limit, skip
+}
+
+func GetLatestPostsUser(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	uuid := user.UUID
+
+	// Extract pagination parameters
+	_, limit, skip := Paginate(c)
 
 	// Define the filter to exclude the document with ID 0 and empty string
 	filter := bson.M{
@@ -161,18 +205,11 @@ func GetLatestPostsUser(c echo.Context) error {
 
 func GetLatestPosts(c echo.Context) error {
 	// Extract pagination parameters
-	page, err := strconv.Atoi(c.QueryParam("page"))
-	if err != nil || page < 1 {
-		page = 1
-	}
-	limit, err := strconv.Atoi(c.QueryParam("limit"))
-	if err != nil || limit < 1 {
-		limit = 10
-	}
-	skip := (page - 1) * limit
+	_, limit, skip := Paginate(c)
 
-	// Define the filter to exclude the document with ID 0
-	filter := bson.M{"blog_id": bson.M{"$ne": ""}}
+	// Define the filter to exclude the document with ID 0 and unpublished posts
+	filter := PublishedFilter()
+	filter["blog_id"] = bson.M{"$ne": ""}
 	// Define options to skip and limit the documents
 	findOptions := options.Find()
 	findOptions.SetSkip(int64(skip))
@@ -196,6 +233,35 @@ func GetLatestPosts(c echo.Context) error {
 
 }
 
+// GetAuthorPosts returns a page of an author's published posts, newest first,
+// together with the total number of published posts they have.
+func GetAuthorPosts(ctx context.Context, author string, limit int, skip int) ([]BlogPost, int64, error) {
+	filter := PublishedFilter()
+	filter["author"] = author
+
+	total, err := database.DB_Main.Collection("posts").CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting posts: %v", err)
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.M{"date": -1})
+	findOptions.SetSkip(int64(skip))
+	findOptions.SetLimit(int64(limit))
+
+	cursor, err := database.DB_Main.Collection("posts").Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching posts: %v", err)
+	}
+
+	posts := []BlogPost{}
+	if err := cursor.All(ctx, &posts); err != nil {
+		return nil, 0, fmt.Errorf("error decoding posts: %v", err)
+	}
+
+	return posts, total, nil
+}
+
 func DeleteUserPost(c echo.Context) error {
 	id := c.Param("id")
 	user := auth.GetUserFromContext(c)
@@ -203,24 +269,180 @@ func DeleteUserPost(c echo.Context) error {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
 	}
 
-	uuid := user.UUID
+	if err := deletePost(c.Request().Context(), user.UUID, user.Username, id); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
 
-	// Define the filter to exclude the document with ID 0
-	filter := bson.M{"blog_id": id}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Post deleted"})
+}
 
-	_, err := database.DB_Users.Collection(uuid).DeleteOne(c.Request().Context(), filter)
+// DeletePost deletes any user's post. It is routed behind auth.Require(auth.PermPostsDeleteAny).
+func DeletePost(c echo.Context) error {
+	author, err := auth.GetUserByUsername(c.Param("user"))
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error deleting post"})
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
+	}
+	id := c.Param("id")
+	if _, err := getOwnPost(c.Request().Context(), author.UUID, id); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
 	}
 
-	_, err = database.DB_Main.Collection("posts").DeleteOne(c.Request().Context(), filter)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error deleting post"})
+	if err := deletePost(c.Request().Context(), author.UUID, author.Username, id); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
 
 	return c.JSON(http.StatusOK, map[string]string{"message": "Post deleted"})
 }
 
+// deletePost removes both copies of a post, its comments and its revisions.
+func deletePost(ctx context.Context, uuid string, author string, id string) error {
+	_, err := database.DB_Users.Collection(uuid).DeleteOne(ctx, bson.M{"blog_id": id})
+	if err != nil {
+		return fmt.Errorf("Error deleting post")
+	}
+
+	_, err = database.DB_Main.Collection("posts").DeleteOne(ctx, bson.M{"blog_id": id, "author": author})
+	if err != nil {
+		return fmt.Errorf("Error deleting post")
+	}
+
+	err = deleteComments(ctx, bson.M{"post_author": author, "blog_id": id})
+	if err != nil {
+		return fmt.Errorf("Error deleting comments")
+	}
+
+	_, err = revisions().DeleteMany(ctx, bson.M{"blog_id": id, "owner": uuid})
+	if err != nil {
+		return fmt.Errorf("Error deleting revisions")
+	}
+
+	if err := setSchedule(ctx, uuid, id, "", ""); err != nil {
+		return fmt.Errorf("Error deleting post")
+	}
+	return nil
+}
+
+// GetUserPosts returns all of a user's posts, whatever their status, oldest first.
+func GetUserPosts(ctx context.Context, uuid string) ([]BlogPost, error) {
+	filter := bson.M{"blog_id": bson.M{"$exists": true}}
+	cursor, err := database.DB_Users.Collection(uuid).Find(ctx, filter, options.Find().SetSort(bson.M{"date": 1}))
+	if err != nil {
+		return nil, err
+	}
+	posts := []BlogPost{}
+	if err := cursor.All(ctx, &posts); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// OpenImage opens an image in GridFS for reading. The file name is in
+// GetFile().Name.
+func OpenImage(image primitive.ObjectID) (*gridfs.DownloadStream, error) {
+	bucket, err := gridfs.NewBucket(database.DB_Users)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.OpenDownloadStream(image)
+}
+
+// RenameAuthor moves a user's posts, comments and analytics from the old
+// username to the new one. Buffered views are flushed first so they aren't
+// written under the old name afterwards.
+func RenameAuthor(ctx context.Context, uuid string, oldName string, newName string) error {
+	FlushViews()
+
+	rename := bson.M{"$set": bson.M{"author": newName}}
+	if _, err := database.DB_Users.Collection(uuid).UpdateMany(ctx, bson.M{"author": oldName}, rename); err != nil {
+		return err
+	}
+	if _, err := database.DB_Main.Collection("posts").UpdateMany(ctx, bson.M{"author": oldName}, rename); err != nil {
+		return err
+	}
+	if _, err := analytics().UpdateMany(ctx, bson.M{"author": oldName}, rename); err != nil {
+		return err
+	}
+	if _, err := comments().UpdateMany(ctx, bson.M{"post_author": oldName}, bson.M{"$set": bson.M{"post_author": newName}}); err != nil {
+		return err
+	}
+	_, err := comments().UpdateMany(ctx, bson.M{"user_uuid": uuid}, bson.M{"$set": bson.M{"username": newName}})
+	return err
+}
+
+// DeleteAuthor removes everything a user has posted: their posts and the
+// images and revisions of them, comments on their posts and comments they
+// wrote, their analytics and trusted commenters. It has to run before the
+// user's collection is dropped, since that is where the posts are listed.
+func DeleteAuthor(ctx context.Context, uuid string, author string) error {
+	FlushViews()
+
+	images := make(map[primitive.ObjectID]bool)
+	posts, err := GetUserPosts(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	for _, post := range posts {
+		images[post.Image] = true
+	}
+	cursor, err := revisions().Find(ctx, bson.M{"owner": uuid})
+	if err != nil {
+		return err
+	}
+	var revs []Revision
+	if err := cursor.All(ctx, &revs); err != nil {
+		return err
+	}
+	for _, rev := range revs {
+		images[rev.Image] = true
+	}
+
+	bucket, err := gridfs.NewBucket(database.DB_Users)
+	if err != nil {
+		return err
+	}
+	for image := range images {
+		if image.IsZero() {
+			continue
+		}
+		if err := bucket.Delete(image); err != nil && err != gridfs.ErrFileNotFound {
+			return err
+		}
+	}
+
+	if _, err := database.DB_Main.Collection("posts").DeleteMany(ctx, bson.M{"author": author}); err != nil {
+		return err
+	}
+	if _, err := revisions().DeleteMany(ctx, bson.M{"owner": uuid}); err != nil {
+		return err
+	}
+	if _, err := scheduledPosts().DeleteMany(ctx, bson.M{"owner": uuid}); err != nil {
+		return err
+	}
+	if err := deleteComments(ctx, bson.M{"post_author": author}); err != nil {
+		return err
+	}
+	// replies to the user's comments go with them, as when a comment is deleted
+	cursor, err = comments().Find(ctx, bson.M{"user_uuid": uuid}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var written []Comment
+	if err := cursor.All(ctx, &written); err != nil {
+		return err
+	}
+	for _, comment := range written {
+		if err := deleteCommentThread(ctx, comment.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := analytics().DeleteMany(ctx, bson.M{"author": author}); err != nil {
+		return err
+	}
+	filter := bson.M{"$or": []bson.M{{"owner": uuid}, {"user_uuid": uuid}}}
+	_, err = trustedCommenters().DeleteMany(ctx, filter)
+	return err
+}
+
 func GetPost(c echo.Context, user string, id string) (*BlogPost, error) {
 
 	userDoc, err := auth.GetUserByUsername(user)
@@ -236,6 +458,10 @@ func GetPost(c echo.Context, user string, id string) (*BlogPost, error) {
 		return nil, fmt.Errorf("Error fetching post")
 	}
 
+	if !post.IsVisibleTo(auth.GetUserFromContext(c).Username) {
+		return nil, fmt.Errorf("Error fetching post")
+	}
+
 	return &post, nil
 }
 
@@ -266,6 +492,10 @@ func GetPostImage(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching post"})
 	}
+	// a draft's image is as private as the draft
+	if !post.IsVisibleTo(auth.GetUserFromContext(c).Username) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
+	}
 
 	bucket, _ := gridfs.NewBucket(database.DB_Users)
 	var buf bytes.Buffer
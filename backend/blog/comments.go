@@ -0,0 +1,280 @@
+package blog
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	commentMaxLength  = 5000
+	guestNameLength   = 50
+	commentMaxDepth   = 8
+	commentEditWindow = 15 * time.Minute
+)
+
+type CommentRequest struct {
+	Comment  string `json:"comment" form:"comment"`
+	ParentID string `json:"parent_id" form:"parent_id"`
+	Name     string `json:"name" form:"name"`
+}
+
+// Comments live in their own collection rather than in BlogPost.Comments so a
+// popular post doesn't grow its document without bound.
+func comments() *mongo.Collection {
+	return database.DB_Main.Collection("comments")
+}
+
+// GetComments returns the visible comments of a post as a tree, oldest first.
+func GetComments(ctx context.Context, author string, id string) ([]*Comment, error) {
+	filter := visibleCommentFilter()
+	filter["post_author"] = author
+	filter["blog_id"] = id
+	findOptions := options.Find().SetSort(bson.M{"date": 1})
+	cursor, err := comments().Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	var flat []*Comment
+	if err := cursor.All(ctx, &flat); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[primitive.ObjectID]*Comment, len(flat))
+	for _, comment := range flat {
+		byID[comment.ID] = comment
+	}
+	roots := []*Comment{}
+	// replies to a comment that has since been hidden are hidden with it
+	for _, comment := range flat {
+		if comment.ParentID.IsZero() {
+			roots = append(roots, comment)
+		} else if parent, ok := byID[comment.ParentID]; ok {
+			parent.Replies = append(parent.Replies, comment)
+		}
+	}
+	return roots, nil
+}
+
+// GetUserComments returns every comment a user wrote, oldest first, whatever
+// its status.
+func GetUserComments(ctx context.Context, uuid string) ([]Comment, error) {
+	cursor, err := comments().Find(ctx, bson.M{"user_uuid": uuid}, options.Find().SetSort(bson.M{"date": 1}))
+	if err != nil {
+		return nil, err
+	}
+	written := []Comment{}
+	if err := cursor.All(ctx, &written); err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+func ListComments(c echo.Context) error {
+	post, err := GetPost(c, c.Param("user"), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
+	}
+
+	tree, err := GetComments(c.Request().Context(), post.Author, post.BlogID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching comments"})
+	}
+
+	return c.JSON(http.StatusOK, tree)
+}
+
+// NewComment adds a comment according to the post's comment policy. Guests may
+// comment on open posts; comments that need approval are stored as pending.
+func NewComment(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+
+	var req CommentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	text := strings.TrimSpace(req.Comment)
+	if text == "" || len(text) > commentMaxLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid comment"})
+	}
+
+	post, err := GetPost(c, c.Param("user"), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
+	}
+	owner, err := auth.GetUserByUsername(post.Author)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
+	}
+	ctx := c.Request().Context()
+
+	comment := Comment{
+		Comment:    text,
+		BlogID:     post.BlogID,
+		PostAuthor: post.Author,
+		Path:       []primitive.ObjectID{},
+		UserUUID:   user.UUID,
+		Username:   user.Username,
+		Date:       time.Now().Format(time.RFC3339),
+		Status:     CommentApproved,
+	}
+
+	policy := effectivePolicy(owner, post)
+	switch {
+	case policy == PolicyClosed:
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Comments are closed"})
+	case user.Email == "" && policy != PolicyOpen:
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	case user.Email != "" && !user.Can(auth.PermCommentsCreate):
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Forbidden"})
+	case user.Email == "":
+		name := strings.TrimSpace(req.Name)
+		if name == "" || len(name) > guestNameLength {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Name is required"})
+		}
+		comment.Username = name
+		comment.Guest = true
+	case policy == PolicyApproval && user.UUID != owner.UUID && !isTrusted(ctx, owner.UUID, user.UUID):
+		comment.Status = CommentPending
+	}
+
+	if req.ParentID != "" {
+		parentID, err := primitive.ObjectIDFromHex(req.ParentID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid parent comment"})
+		}
+		// pending and spam comments can't be replied to; the reply would have nothing to hang from
+		filter := visibleCommentFilter()
+		filter["_id"] = parentID
+		filter["post_author"] = post.Author
+		filter["blog_id"] = post.BlogID
+		var parent Comment
+		err = comments().FindOne(ctx, filter).Decode(&parent)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid parent comment"})
+		}
+		if len(parent.Path) >= commentMaxDepth {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Thread is too deep"})
+		}
+		comment.ParentID = parent.ID
+		comment.Path = append(parent.Path, parent.ID)
+	}
+
+	res, err := comments().InsertOne(ctx, comment)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error creating comment"})
+	}
+	comment.ID = res.InsertedID.(primitive.ObjectID)
+
+	if comment.Status == CommentApproved {
+		if err := database.IncrementStat("comment_count", 1); err != nil {
+			logs.Error(err)
+		}
+	}
+
+	return c.JSON(http.StatusCreated, comment)
+}
+
+// EditComment lets the author of a comment change it within commentEditWindow.
+func EditComment(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	var req CommentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	text := strings.TrimSpace(req.Comment)
+	if text == "" || len(text) > commentMaxLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid comment"})
+	}
+
+	comment, err := getComment(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Comment not found"})
+	}
+	if comment.UserUUID == "" || comment.UserUUID != user.UUID {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Forbidden"})
+	}
+	date, err := time.Parse(time.RFC3339, comment.Date)
+	if err != nil || time.Since(date) > commentEditWindow {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Comment can no longer be edited"})
+	}
+
+	update := bson.M{"$set": bson.M{"comment": text, "edited": time.Now().Format(time.RFC3339)}}
+	_, err = comments().UpdateOne(c.Request().Context(), bson.M{"_id": comment.ID}, update)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error updating comment"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Comment updated"})
+}
+
+// DeleteComment removes a comment and its replies. The comment's author and
+// the owner of the post may both delete it.
+func DeleteComment(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	comment, err := getComment(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Comment not found"})
+	}
+	isCommenter := comment.UserUUID != "" && comment.UserUUID == user.UUID
+	if !isCommenter && comment.PostAuthor != user.Username && !user.Can(auth.PermCommentsDeleteAny) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Forbidden"})
+	}
+
+	if err := deleteCommentThread(c.Request().Context(), comment.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error deleting comment"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Comment deleted"})
+}
+
+func getComment(c echo.Context) (*Comment, error) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	var comment Comment
+	err = comments().FindOne(c.Request().Context(), bson.M{"_id": id}).Decode(&comment)
+	if err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+func deleteCommentThread(ctx context.Context, id primitive.ObjectID) error {
+	filter := bson.M{"$or": []bson.M{{"_id": id}, {"path": id}}}
+	return deleteComments(ctx, filter)
+}
+
+// deleteComments removes every matching comment and keeps comment_count in step.
+func deleteComments(ctx context.Context, filter bson.M) error {
+	visible := countVisible(ctx, filter)
+	_, err := comments().DeleteMany(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if visible > 0 {
+		if err := database.IncrementStat("comment_count", -int(visible)); err != nil {
+			logs.Error(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package blog
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Comment policies, set per blog on auth.User and optionally overridden per post.
+const (
+	PolicyOpen     = "open"
+	PolicyApproval = "approval"
+	PolicyLoggedIn = "loggedin"
+	PolicyClosed   = "closed"
+)
+
+const (
+	CommentApproved = "approved"
+	CommentPending  = "pending"
+	CommentSpam     = "spam"
+)
+
+type TrustedCommenter struct {
+	Owner    string `bson:"owner"`
+	UserUUID string `bson:"user_uuid"`
+	Date     string `bson:"date"`
+}
+
+type PolicyRequest struct {
+	Policy    string `json:"policy" form:"policy"`
+	AutoTrust bool   `json:"auto_trust" form:"auto_trust"`
+}
+
+func trustedCommenters() *mongo.Collection {
+	return database.DB_Main.Collection("trusted_commenters")
+}
+
+func validPolicy(policy string) bool {
+	switch policy {
+	case PolicyOpen, PolicyApproval, PolicyLoggedIn, PolicyClosed:
+		return true
+	}
+	return false
+}
+
+// effectivePolicy resolves the policy for a post: the post override first, then
+// the blog default, then loggedin, which is how comments behaved before policies.
+func effectivePolicy(owner auth.User, post *BlogPost) string {
+	if validPolicy(post.CommentPolicy) {
+		return post.CommentPolicy
+	}
+	if validPolicy(owner.CommentPolicy) {
+		return owner.CommentPolicy
+	}
+	return PolicyLoggedIn
+}
+
+// CommentPolicyFor returns the effective comment policy of a post.
+func CommentPolicyFor(post *BlogPost) string {
+	owner, err := auth.GetUserByUsername(post.Author)
+	if err != nil {
+		return PolicyClosed
+	}
+	return effectivePolicy(owner, post)
+}
+
+// visibleCommentFilter hides comments that are waiting for approval or were marked as spam.
+// Comments created before moderation existed have no status and are visible.
+func visibleCommentFilter() bson.M {
+	return bson.M{"status": bson.M{"$nin": []string{CommentPending, CommentSpam}}}
+}
+
+func isTrusted(ctx context.Context, owner string, userUUID string) bool {
+	if userUUID == "" {
+		return false
+	}
+	count, err := trustedCommenters().CountDocuments(ctx, bson.M{"owner": owner, "user_uuid": userUUID})
+	return err == nil && count > 0
+}
+
+// GetPendingComments lists the comments waiting for approval on an author's posts.
+func GetPendingComments(ctx context.Context, author string) ([]Comment, error) {
+	findOptions := options.Find().SetSort(bson.M{"date": 1})
+	cursor, err := comments().Find(ctx, bson.M{"post_author": author, "status": CommentPending}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	pending := []Comment{}
+	if err := cursor.All(ctx, &pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func ListPendingComments(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	pending, err := GetPendingComments(c.Request().Context(), user.Username)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching comments"})
+	}
+
+	return c.JSON(http.StatusOK, pending)
+}
+
+// ModerateComment approves, rejects or marks as spam a comment on one of the user's posts.
+func ModerateComment(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	comment, err := getComment(c)
+	if err != nil || (comment.PostAuthor != user.Username && !user.Can(auth.PermCommentsModerate)) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Comment not found"})
+	}
+	ctx := c.Request().Context()
+
+	switch c.Param("action") {
+	case "approve":
+		if err := setCommentStatus(ctx, comment, CommentApproved); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error updating comment"})
+		}
+		// trust is granted by the post's owner, also when a moderator approves
+		owner, err := auth.GetUserByUsername(comment.PostAuthor)
+		if err == nil && owner.AutoTrustCommenters && comment.UserUUID != "" {
+			filter := bson.M{"owner": owner.UUID, "user_uuid": comment.UserUUID}
+			update := bson.M{"$setOnInsert": TrustedCommenter{Owner: owner.UUID, UserUUID: comment.UserUUID, Date: time.Now().Format(time.RFC3339)}}
+			if _, err := trustedCommenters().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+				logs.Error("Error trusting commenter:", err)
+			}
+		}
+	case "reject":
+		if err := deleteCommentThread(ctx, comment.ID); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error deleting comment"})
+		}
+	case "spam":
+		if err := setCommentStatus(ctx, comment, CommentSpam); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error updating comment"})
+		}
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown action"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Comment moderated"})
+}
+
+// setCommentStatus changes a comment's status and keeps comment_count counting
+// only visible comments.
+func setCommentStatus(ctx context.Context, comment *Comment, status string) error {
+	_, err := comments().UpdateOne(ctx, bson.M{"_id": comment.ID}, bson.M{"$set": bson.M{"status": status}})
+	if err != nil {
+		return err
+	}
+
+	wasVisible := comment.Status != CommentPending && comment.Status != CommentSpam
+	isVisible := status == CommentApproved
+	switch {
+	case isVisible && !wasVisible:
+		err = database.IncrementStat("comment_count", 1)
+	case !isVisible && wasVisible:
+		err = database.IncrementStat("comment_count", -1)
+	}
+	if err != nil {
+		logs.Error(err)
+	}
+	return nil
+}
+
+// UpdateCommentPolicy sets the default comment policy for all of the user's posts.
+func UpdateCommentPolicy(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	var req PolicyRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+	if !validPolicy(req.Policy) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid policy"})
+	}
+
+	update := bson.M{"$set": bson.M{"commentpolicy": req.Policy, "autotrustcommenters": req.AutoTrust}}
+	_, err := database.DB_Users.Collection(user.UUID).UpdateOne(c.Request().Context(), bson.M{"uuid": user.UUID}, update)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Comment policy updated"})
+}
+
+func countVisible(ctx context.Context, filter bson.M) int64 {
+	visible := visibleCommentFilter()
+	count, err := comments().CountDocuments(ctx, bson.M{"$and": []bson.M{filter, visible}})
+	if err != nil {
+		logs.Error("Error counting comments:", err)
+		return 0
+	}
+	return count
+}
@@ -0,0 +1,413 @@
+package blog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/database"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Revision is a snapshot of a post taken right before it was edited or restored.
+type Revision struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	BlogID  string             `bson:"blog_id" json:"blog_id"`
+	Owner   string             `bson:"owner" json:"-"`
+	Number  int                `bson:"number" json:"number"`
+	Title   string             `bson:"title" json:"title"`
+	Content string             `bson:"content" json:"content"`
+	Tags    []string           `bson:"tags" json:"tags"`
+	CSS     string             `bson:"css" json:"css"`
+	Image   primitive.ObjectID `bson:"image" json:"image"`
+	Date    string             `bson:"date" json:"date"`
+}
+
+type DiffLine struct {
+	Op   string `json:"op"` // "=", "+" or "-"
+	Text string `json:"text"`
+}
+
+func revisions() *mongo.Collection {
+	return database.DB_Main.Collection("revisions")
+}
+
+// getOwnPost loads a post from the user's own collection.
+func getOwnPost(ctx context.Context, uuid string, id string) (*BlogPost, error) {
+	var post BlogPost
+	err := database.DB_Users.Collection(uuid).FindOne(ctx, bson.M{"blog_id": id}).Decode(&post)
+	if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// updatePost applies the same $set to the per-user copy and the DB_Main.posts copy.
+func updatePost(ctx context.Context, uuid string, author string, id string, set bson.M) error {
+	_, err := database.DB_Users.Collection(uuid).UpdateOne(ctx, bson.M{"blog_id": id}, bson.M{"$set": set})
+	if err != nil {
+		return fmt.Errorf("error updating user post: %v", err)
+	}
+	_, err = database.DB_Main.Collection("posts").UpdateOne(ctx, bson.M{"blog_id": id, "author": author}, bson.M{"$set": set})
+	if err != nil {
+		return fmt.Errorf("error updating main post: %v", err)
+	}
+	return nil
+}
+
+// saveRevision stores the current state of a post as the next revision. The
+// (owner, blog_id, number) index is unique, so two edits racing for the same
+// number retry with the next one.
+func saveRevision(ctx context.Context, uuid string, post *BlogPost) error {
+	rev := Revision{
+		BlogID:  post.BlogID,
+		Owner:   uuid,
+		Title:   post.Title,
+		Content: post.Content,
+		Tags:    post.Tags,
+		CSS:     post.CSS,
+		Image:   post.Image,
+		Date:    time.Now().Format(time.RFC3339),
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		var last Revision
+		opts := options.FindOne().SetSort(bson.M{"number": -1}).SetProjection(bson.M{"number": 1})
+		err := revisions().FindOne(ctx, bson.M{"blog_id": post.BlogID, "owner": uuid}, opts).Decode(&last)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return fmt.Errorf("error numbering revision: %v", err)
+		}
+		rev.Number = last.Number + 1
+		_, err = revisions().InsertOne(ctx, rev)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error saving revision: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("error saving revision: too many concurrent edits")
+}
+
+func getRevision(ctx context.Context, uuid string, id string, number string) (*Revision, error) {
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return nil, err
+	}
+	var rev Revision
+	err = revisions().FindOne(ctx, bson.M{"blog_id": id, "owner": uuid, "number": n}).Decode(&rev)
+	if err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// GetUserRevisions returns all revisions of a user's posts, by post and number.
+func GetUserRevisions(ctx context.Context, uuid string) ([]Revision, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "blog_id", Value: 1}, {Key: "number", Value: 1}})
+	cursor, err := revisions().Find(ctx, bson.M{"owner": uuid}, opts)
+	if err != nil {
+		return nil, err
+	}
+	revs := []Revision{}
+	if err := cursor.All(ctx, &revs); err != nil {
+		return nil, err
+	}
+	return revs, nil
+}
+
+// UpdateUserPost edits a post in place so its BlogID (and links to it) stay the same.
+// Only the form fields that are sent are changed; the previous version is kept as a revision.
+func UpdateUserPost(c echo.Context) error {
+	id := c.Param("id")
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	ctx := c.Request().Context()
+
+	post, err := getOwnPost(ctx, user.UUID, id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
+	}
+
+	form, err := c.FormParams()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Bad Request"})
+	}
+
+	set := bson.M{}
+	if _, ok := form["title"]; ok {
+		title := c.FormValue("title")
+		if title == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Title is required"})
+		}
+		set["title"] = title
+	}
+	if _, ok := form["content"]; ok {
+		set["content"] = c.FormValue("content")
+	}
+	if _, ok := form["tags"]; ok {
+		set["tags"] = NormalizeTags(c.FormValue("tags"))
+	}
+	if _, ok := form["css"]; ok {
+		if !user.Can(auth.PermPostsCustomCSS) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Custom CSS needs premium"})
+		}
+		set["css"] = c.FormValue("css")
+	}
+
+	// The old image is left in GridFS because revisions still reference it.
+	if image, err := c.FormFile("image"); err == nil {
+		file, err := image.Open()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error opening image file"})
+		}
+		defer file.Close()
+
+		bucket, err := gridfs.NewBucket(database.DB_Users)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error creating GridFS bucket"})
+		}
+		data, err := bucket.UploadFromStream(image.Filename, file)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error reading image file"})
+		}
+		set["image"] = data
+	}
+
+	if _, ok := form["comment_policy"]; ok {
+		// an empty policy clears the override and falls back to the blog default
+		policy := c.FormValue("comment_policy")
+		if policy != "" && !validPolicy(policy) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid comment policy"})
+		}
+		set["comment_policy"] = policy
+	}
+	_, statusSent := form["status"]
+	var status, publishAt string
+	if statusSent {
+		status, publishAt, err = parseStatus(c.FormValue("status"), c.FormValue("publish_at"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if !canPublish(user.UUID, status) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Verify your email before publishing"})
+		}
+		set["status"] = status
+		set["publish_at"] = publishAt
+	}
+
+	if len(set) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Nothing to update"})
+	}
+
+	if err := saveRevision(ctx, user.UUID, post); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error saving revision"})
+	}
+	set["updated"] = time.Now().Format(time.RFC3339)
+	if err := updatePost(ctx, user.UUID, user.Username, id, set); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error updating post"})
+	}
+
+	if statusSent {
+		if err := setSchedule(ctx, user.UUID, id, status, publishAt); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error updating post"})
+		}
+		if err := syncMirror(ctx, user.UUID, id, post.IsPublished()); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error updating post"})
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Post updated"})
+}
+
+// ListRevisions returns the saved revisions of one of the user's posts, newest first.
+func ListRevisions(c echo.Context) error {
+	id := c.Param("id")
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	findOptions := options.Find().SetSort(bson.M{"number": -1})
+	cursor, err := revisions().Find(c.Request().Context(), bson.M{"blog_id": id, "owner": user.UUID}, findOptions)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching revisions"})
+	}
+
+	revs := []Revision{}
+	if err := cursor.All(c.Request().Context(), &revs); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching revisions"})
+	}
+
+	return c.JSON(http.StatusOK, revs)
+}
+
+// DiffRevision compares a revision with the current post, or with another
+// revision when ?against=<number> is given.
+func DiffRevision(c echo.Context) error {
+	id := c.Param("id")
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	ctx := c.Request().Context()
+
+	rev, err := getRevision(ctx, user.UUID, id, c.Param("rev"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Revision not found"})
+	}
+
+	var title, content, css string
+	var tags []string
+	if against := c.QueryParam("against"); against != "" {
+		other, err := getRevision(ctx, user.UUID, id, against)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Revision not found"})
+		}
+		title, content, tags, css = other.Title, other.Content, other.Tags, other.CSS
+	} else {
+		post, err := getOwnPost(ctx, user.UUID, id)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
+		}
+		title, content, tags, css = post.Title, post.Content, post.Tags, post.CSS
+	}
+
+	return c.JSON(http.StatusOK, map[string][]DiffLine{
+		"title":   diffLines(rev.Title, title),
+		"content": diffLines(rev.Content, content),
+		"tags":    diffLines(strings.Join(rev.Tags, "\n"), strings.Join(tags, "\n")),
+		"css":     diffLines(rev.CSS, css),
+	})
+}
+
+// RestoreRevision puts an older revision back as the current version of the post.
+// The version being replaced is saved as a new revision first, so restoring can be undone.
+func RestoreRevision(c echo.Context) error {
+	id := c.Param("id")
+	user := auth.GetUserFromContext(c)
+	if user.Email == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	ctx := c.Request().Context()
+
+	post, err := getOwnPost(ctx, user.UUID, id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Post not found"})
+	}
+	rev, err := getRevision(ctx, user.UUID, id, c.Param("rev"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Revision not found"})
+	}
+
+	if err := saveRevision(ctx, user.UUID, post); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error saving revision"})
+	}
+	set := bson.M{
+		"title":   rev.Title,
+		"content": rev.Content,
+		"tags":    rev.Tags,
+		"css":     rev.CSS,
+		"image":   rev.Image,
+		"updated": time.Now().Format(time.RFC3339),
+	}
+	// without premium the post keeps the CSS it has
+	if !user.Can(auth.PermPostsCustomCSS) {
+		delete(set, "css")
+	}
+	if err := updatePost(ctx, user.UUID, user.Username, id, set); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error restoring revision"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Revision restored"})
+}
+
+// Diffs bigger than this many LCS cells (after the common start and end are
+// trimmed) are shown as the whole old text replaced by the new one.
+const maxDiffCells = 1 << 20
+
+// diffLines is a plain LCS line diff from a to b.
+func diffLines(a, b string) []DiffLine {
+	x := strings.Split(a, "\n")
+	y := strings.Split(b, "\n")
+
+	diff := []DiffLine{}
+	for len(x) > 0 && len(y) > 0 && x[0] == y[0] {
+		diff = append(diff, DiffLine{Op: "=", Text: x[0]})
+		x, y = x[1:], y[1:]
+	}
+	var tail []DiffLine
+	for len(x) > 0 && len(y) > 0 && x[len(x)-1] == y[len(y)-1] {
+		tail = append(tail, DiffLine{Op: "=", Text: x[len(x)-1]})
+		x, y = x[:len(x)-1], y[:len(y)-1]
+	}
+
+	if (len(x)+1)*(len(y)+1) > maxDiffCells {
+		for _, line := range x {
+			diff = append(diff, DiffLine{Op: "-", Text: line})
+		}
+		for _, line := range y {
+			diff = append(diff, DiffLine{Op: "+", Text: line})
+		}
+	} else {
+		diff = append(diff, lcsDiff(x, y)...)
+	}
+
+	for i := len(tail) - 1; i >= 0; i-- {
+		diff = append(diff, tail[i])
+	}
+	return diff
+}
+
+func lcsDiff(x, y []string) []DiffLine {
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := []DiffLine{}
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			diff = append(diff, DiffLine{Op: "=", Text: x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{Op: "-", Text: x[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{Op: "+", Text: y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		diff = append(diff, DiffLine{Op: "-", Text: x[i]})
+	}
+	for ; j < len(y); j++ {
+		diff = append(diff, DiffLine{Op: "+", Text: y[j]})
+	}
+	return diff
+}
@@ -0,0 +1,186 @@
+package blog
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	StatusDraft     = "draft"
+	StatusScheduled = "scheduled"
+	StatusPublished = "published"
+	StatusUnlisted  = "unlisted"
+)
+
+// IsPublished reports whether the post is live. Posts created before statuses
+// existed have an empty status and count as published.
+func (p *BlogPost) IsPublished() bool {
+	return p.Status == "" || p.Status == StatusPublished
+}
+
+// IsVisibleTo reports whether a viewer may open the post by its URL.
+// Unlisted posts are reachable by link; drafts and scheduled posts only by their author.
+func (p *BlogPost) IsVisibleTo(username string) bool {
+	if p.IsPublished() || p.Status == StatusUnlisted {
+		return true
+	}
+	return username != "" && username == p.Author
+}
+
+// PublishedFilter matches posts that may appear in public listings.
+func PublishedFilter() bson.M {
+	return bson.M{"status": bson.M{"$nin": []string{StatusDraft, StatusScheduled, StatusUnlisted}}}
+}
+
+// parseStatus validates a status and publish time from a form. An empty status
+// means published. PublishAt is returned in UTC so it can be compared as a string.
+func parseStatus(status string, publishAt string) (string, string, error) {
+	status = strings.ToLower(strings.TrimSpace(status))
+	switch status {
+	case "":
+		return StatusPublished, "", nil
+	case StatusDraft, StatusPublished, StatusUnlisted:
+		return status, "", nil
+	case StatusScheduled:
+		t, err := time.Parse(time.RFC3339, publishAt)
+		if err != nil {
+			return "", "", fmt.Errorf("publish_at must be an RFC3339 time")
+		}
+		if !t.After(time.Now()) {
+			return "", "", fmt.Errorf("publish_at must be in the future")
+		}
+		return status, t.UTC().Format(time.RFC3339), nil
+	default:
+		return "", "", fmt.Errorf("unknown status %q", status)
+	}
+}
+
+// canPublish reports whether the user may give a post the status. Anything but
+// a draft counts as publishing, and needs a verified email when the operator
+// requires one.
+func canPublish(uuid string, status string) bool {
+	if status == StatusDraft || !auth.RequireVerifiedEmail() {
+		return true
+	}
+	return auth.IsEmailVerified(uuid)
+}
+
+// mirrorPost copies a post from the author's collection into DB_Main.posts,
+// replacing any existing copy.
+func mirrorPost(ctx context.Context, post *BlogPost) error {
+	doc := *post
+	doc.ID = primitive.NilObjectID
+	filter := bson.M{"blog_id": post.BlogID, "author": post.Author}
+	_, err := database.DB_Main.Collection("posts").ReplaceOne(ctx, filter, doc, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("error mirroring post: %v", err)
+	}
+	return nil
+}
+
+// unmirrorPost removes a post from DB_Main.posts, leaving the author's copy alone.
+func unmirrorPost(ctx context.Context, post *BlogPost) error {
+	_, err := database.DB_Main.Collection("posts").DeleteOne(ctx, bson.M{"blog_id": post.BlogID, "author": post.Author})
+	if err != nil {
+		return fmt.Errorf("error removing mirrored post: %v", err)
+	}
+	return nil
+}
+
+// syncMirror adds or removes the DB_Main.posts copy after a status change.
+func syncMirror(ctx context.Context, uuid string, id string, wasPublished bool) error {
+	post, err := getOwnPost(ctx, uuid, id)
+	if err != nil {
+		return err
+	}
+	if post.IsPublished() && !wasPublished {
+		// a draft going live is dated from the moment it was published
+		post.Date = time.Now().Format(time.RFC3339)
+		_, err := database.DB_Users.Collection(uuid).UpdateOne(ctx, bson.M{"_id": post.ID}, bson.M{"$set": bson.M{"date": post.Date}})
+		if err != nil {
+			return fmt.Errorf("error updating post date: %v", err)
+		}
+		return mirrorPost(ctx, post)
+	}
+	if !post.IsPublished() && wasPublished {
+		return unmirrorPost(ctx, post)
+	}
+	return nil
+}
+
+// ScheduledPost lists a scheduled post in DB_Main so the publisher doesn't
+// have to search every user's collection.
+type ScheduledPost struct {
+	Owner     string `bson:"owner"`
+	BlogID    string `bson:"blog_id"`
+	PublishAt string `bson:"publish_at"`
+}
+
+func scheduledPosts() *mongo.Collection {
+	return database.DB_Main.Collection("scheduled_posts")
+}
+
+// setSchedule lists the post in scheduled_posts if it is scheduled, and
+// removes it otherwise.
+func setSchedule(ctx context.Context, uuid string, id string, status string, publishAt string) error {
+	filter := bson.M{"owner": uuid, "blog_id": id}
+	if status != StatusScheduled {
+		if _, err := scheduledPosts().DeleteOne(ctx, filter); err != nil {
+			return fmt.Errorf("error unscheduling post: %v", err)
+		}
+		return nil
+	}
+	entry := ScheduledPost{Owner: uuid, BlogID: id, PublishAt: publishAt}
+	if _, err := scheduledPosts().ReplaceOne(ctx, filter, entry, options.Replace().SetUpsert(true)); err != nil {
+		return fmt.Errorf("error scheduling post: %v", err)
+	}
+	return nil
+}
+
+// PublishScheduledPosts flips every scheduled post whose time has come to
+// published and mirrors it into DB_Main.posts. It is run by the scheduler.
+func PublishScheduledPosts() error {
+	ctx := context.Background()
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	cursor, err := scheduledPosts().Find(ctx, bson.M{"publish_at": bson.M{"$lte": now}})
+	if err != nil {
+		return fmt.Errorf("error fetching scheduled posts: %v", err)
+	}
+	var due []ScheduledPost
+	if err := cursor.All(ctx, &due); err != nil {
+		return fmt.Errorf("error decoding scheduled posts: %v", err)
+	}
+
+	for _, entry := range due {
+		var post BlogPost
+		filter := bson.M{"blog_id": entry.BlogID, "status": StatusScheduled}
+		update := bson.M{"$set": bson.M{"status": StatusPublished, "date": time.Now().Format(time.RFC3339)}, "$unset": bson.M{"publish_at": ""}}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := database.DB_Users.Collection(entry.Owner).FindOneAndUpdate(ctx, filter, update, opts).Decode(&post)
+		if err == nil {
+			if err := mirrorPost(ctx, &post); err != nil {
+				logs.Error(err)
+				continue
+			}
+		} else if err != mongo.ErrNoDocuments {
+			logs.Error("Error publishing scheduled post:", err)
+			continue
+		}
+		// a post that was deleted or rescheduled meanwhile just leaves the list
+		if err := setSchedule(ctx, entry.Owner, entry.BlogID, StatusPublished, ""); err != nil {
+			logs.Error(err)
+		}
+	}
+	return nil
+}
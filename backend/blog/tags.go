@@ -0,0 +1,175 @@
+package blog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	maxTags      = 10
+	maxTagLength = 32
+)
+
+type TagCount struct {
+	Tag   string `bson:"_id" json:"tag"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// NormalizeTag lowercases and trims a tag and cuts it to maxTagLength runes.
+func NormalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	tag = strings.TrimPrefix(tag, "#")
+	if utf8.RuneCountInString(tag) > maxTagLength {
+		tag = string([]rune(tag)[:maxTagLength])
+	}
+	return strings.TrimSpace(tag)
+}
+
+// NormalizeTags turns a comma separated list into a sorted, deduplicated
+// list of at most maxTags tags.
+func NormalizeTags(tags string) []string {
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, tag := range strings.Split(tags, ",") {
+		tag = NormalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+		if len(normalized) == maxTags {
+			break
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// TagFilter matches posts carrying the given tag.
+func TagFilter(tag string) bson.M {
+	return bson.M{"tags": NormalizeTag(tag)}
+}
+
+// GetTagCounts aggregates how many published posts use each tag.
+func GetTagCounts(ctx context.Context, limit int) ([]TagCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: PublishedFilter()}},
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cursor, err := database.DB_Main.Collection("posts").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("error aggregating tags: %v", err)
+	}
+	counts := []TagCount{}
+	if err := cursor.All(ctx, &counts); err != nil {
+		return nil, fmt.Errorf("error decoding tags: %v", err)
+	}
+	return counts, nil
+}
+
+// GetTagPosts returns a page of published posts with the given tag, newest first.
+func GetTagPosts(ctx context.Context, tag string, limit int, skip int) ([]BlogPost, int64, error) {
+	filter := PublishedFilter()
+	for key, value := range TagFilter(tag) {
+		filter[key] = value
+	}
+
+	total, err := database.DB_Main.Collection("posts").CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting posts: %v", err)
+	}
+
+	findOptions := options.Find().SetSort(bson.M{"date": -1}).SetSkip(int64(skip)).SetLimit(int64(limit))
+	cursor, err := database.DB_Main.Collection("posts").Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error fetching posts: %v", err)
+	}
+	posts := []BlogPost{}
+	if err := cursor.All(ctx, &posts); err != nil {
+		return nil, 0, fmt.Errorf("error decoding posts: %v", err)
+	}
+	return posts, total, nil
+}
+
+// GetTagCloud returns the most used tags with their post counts.
+func GetTagCloud(c echo.Context) error {
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 100
+	}
+
+	counts, err := GetTagCounts(c.Request().Context(), limit)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error fetching tags"})
+	}
+
+	return c.JSON(http.StatusOK, counts)
+}
+
+// BackfillTags converts posts and revisions that still store their tags as a
+// quoted, comma-joined string into the normalized array form. It is safe to
+// run on every start; documents that are already converted are not matched.
+func BackfillTags() error {
+	ctx := context.Background()
+
+	collections, err := database.DB_Users.ListCollectionNames(ctx, bson.D{})
+	if err != nil {
+		return fmt.Errorf("error listing user collections: %v", err)
+	}
+	for _, name := range collections {
+		if strings.HasPrefix(name, "fs.") {
+			continue
+		}
+		if err := backfillCollection(ctx, database.DB_Users.Collection(name)); err != nil {
+			return err
+		}
+	}
+
+	if err := backfillCollection(ctx, database.DB_Main.Collection("posts")); err != nil {
+		return err
+	}
+	return backfillCollection(ctx, revisions())
+}
+
+func backfillCollection(ctx context.Context, collection *mongo.Collection) error {
+	cursor, err := collection.Find(ctx, bson.M{"tags": bson.M{"$type": "string"}})
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %v", collection.Name(), err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID   interface{} `bson:"_id"`
+			Tags string      `bson:"tags"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			logs.Error("Error decoding tags:", err)
+			continue
+		}
+		raw, err := strconv.Unquote(doc.Tags)
+		if err != nil {
+			raw = doc.Tags
+		}
+		update := bson.M{"$set": bson.M{"tags": NormalizeTags(raw)}}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": doc.ID}, update); err != nil {
+			logs.Error("Error updating tags:", err)
+		}
+	}
+	return cursor.Err()
+}
@@ -0,0 +1,148 @@
+package blog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"blogr.moe/backend/utils/cache"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A visitor is counted once per post per viewWindow.
+var viewWindow = 30 * time.Minute
+
+type pendingViews struct {
+	author string
+	blogID string
+	count  int
+}
+
+// View increments are buffered here and written by FlushViews.
+var (
+	viewsMu sync.Mutex
+	views   = make(map[string]*pendingViews)
+)
+
+// visitorHash identifies a visitor by a salted hash of their IP and user
+// agent, so the raw IP is never stored.
+func visitorHash(c echo.Context) string {
+	salt := os.Getenv("VIEW_SALT")
+	if salt == "" {
+		salt = os.Getenv("SECRET")
+	}
+	sum := sha256.Sum256([]byte(salt + "|" + c.RealIP() + "|" + c.Request().UserAgent()))
+	return hex.EncodeToString(sum[:])
+}
+
+func isBot(userAgent string) bool {
+	ua := strings.ToLower(userAgent)
+	return ua == "" || strings.Contains(ua, "bot") || strings.Contains(ua, "spider") || strings.Contains(ua, "crawl")
+}
+
+// RecordView counts a view of a post unless the same visitor already viewed it
+// within viewWindow. Authors viewing their own posts and obvious bots aren't counted.
+func RecordView(c echo.Context, post *BlogPost) {
+	if !post.IsPublished() || isBot(c.Request().UserAgent()) {
+		return
+	}
+	if viewer := auth.GetUserFromContext(c); viewer.Username != "" && viewer.Username == post.Author {
+		return
+	}
+
+	key := "view:" + post.Author + "/" + post.BlogID + ":" + visitorHash(c)
+	first, err := cache.Default().SetNX(key, "1", viewWindow)
+	if err != nil {
+		logs.Error("Error recording view:", err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	viewsMu.Lock()
+	defer viewsMu.Unlock()
+	postKey := post.Author + "/" + post.BlogID
+	pending, ok := views[postKey]
+	if !ok {
+		pending = &pendingViews{author: post.Author, blogID: post.BlogID}
+		views[postKey] = pending
+	}
+	pending.count++
+
+	recordAnalytics(c, post)
+}
+
+// authorNamed finds a post's author by name, following renames so views
+// buffered under an old name still count. Lookups are remembered in found.
+func authorNamed(ctx context.Context, name string, found map[string]auth.User) (auth.User, error) {
+	if user, ok := found[name]; ok {
+		return user, nil
+	}
+	user, err := auth.GetUserByUsername(name)
+	if err != nil {
+		if user, err = auth.RenamedUser(ctx, name); err != nil {
+			return auth.User{}, err
+		}
+	}
+	found[name] = user
+	return user, nil
+}
+
+// FlushViews writes the buffered view counts to both copies of each post, the
+// author's TotalViews, the global stats and the daily analytics buckets.
+// It is run by the scheduler.
+func FlushViews() {
+	viewsMu.Lock()
+	batch := views
+	views = make(map[string]*pendingViews)
+	viewsMu.Unlock()
+
+	ctx := context.Background()
+	authors := make(map[string]auth.User)
+	flushAnalytics(ctx, authors)
+	if len(batch) == 0 {
+		return
+	}
+
+	total := 0
+	perAuthor := make(map[string]int)
+	for _, pending := range batch {
+		author, err := authorNamed(ctx, pending.author, authors)
+		if err != nil {
+			logs.Error("Error fetching author for views:", err)
+			continue
+		}
+		inc := bson.M{"$inc": bson.M{"views": pending.count}}
+		if _, err := database.DB_Users.Collection(author.UUID).UpdateOne(ctx, bson.M{"blog_id": pending.blogID}, inc); err != nil {
+			logs.Error("Error updating post views:", err)
+			continue
+		}
+		if _, err := database.DB_Main.Collection("posts").UpdateOne(ctx, bson.M{"blog_id": pending.blogID, "author": author.Username}, inc); err != nil {
+			logs.Error("Error updating post views:", err)
+		}
+		perAuthor[author.UUID] += pending.count
+		total += pending.count
+	}
+
+	for uuid, count := range perAuthor {
+		_, err := database.DB_Users.Collection(uuid).UpdateOne(ctx, bson.M{"uuid": uuid}, bson.M{"$inc": bson.M{"totalviews": count}})
+		if err != nil {
+			logs.Error("Error updating author views:", err)
+		}
+	}
+
+	if total > 0 {
+		if err := database.IncrementStat("view_count", total); err != nil {
+			logs.Error(err)
+		}
+	}
+}
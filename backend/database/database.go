@@ -26,7 +26,10 @@ func init() {
 
 	client, err := mongo.NewClient(options.Client().ApplyURI(os.Getenv("MONGO_URI")))
 	if err != nil {
+		// left nil, so packages can still be loaded without a database, e.g.
+		// by unit tests; main refuses to start
 		logs.Error("Error creating MongoDB client")
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -52,6 +55,85 @@ func init() {
 		logs.Error("Error ensuring stats document exists")
 	}
 
+	err = ensureIndexes()
+	if err != nil {
+		logs.Error("Error ensuring indexes:", err)
+	}
+
+}
+
+func ensureIndexes() error {
+	ctx := context.Background()
+	indexes := map[string][]mongo.IndexModel{
+		"posts": {
+			{Keys: bson.D{{Key: "tags", Value: 1}, {Key: "date", Value: -1}}},
+			{Keys: bson.D{{Key: "author", Value: 1}, {Key: "date", Value: -1}}},
+		},
+		"comments": {
+			{Keys: bson.D{{Key: "post_author", Value: 1}, {Key: "blog_id", Value: 1}, {Key: "date", Value: 1}}},
+			{Keys: bson.D{{Key: "path", Value: 1}}},
+			{Keys: bson.D{{Key: "post_author", Value: 1}, {Key: "status", Value: 1}}},
+		},
+		"account_deletions": {
+			{Keys: bson.D{{Key: "delete_at", Value: 1}}},
+		},
+		"data_exports": {
+			{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}},
+		},
+		"analytics": {
+			{Keys: bson.D{{Key: "author", Value: 1}, {Key: "day", Value: 1}}},
+		},
+		"api_tokens": {
+			{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "uuid", Value: 1}}},
+		},
+		"login_audit": {
+			{Keys: bson.D{{Key: "email", Value: 1}, {Key: "date", Value: -1}}},
+			{Keys: bson.D{{Key: "date", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(90 * 24 * 60 * 60)},
+		},
+		"password_resets": {
+			{Keys: bson.D{{Key: "token_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		"payments": {
+			{Keys: bson.D{{Key: "stripe_id", Value: 1}, {Key: "kind", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "uuid", Value: 1}, {Key: "date", Value: -1}}},
+		},
+		"revisions": {
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "blog_id", Value: 1}, {Key: "number", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+		"scheduled_posts": {
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "blog_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "publish_at", Value: 1}}},
+		},
+		"stripe_events": {
+			// kept for 30 days, well past the three days Stripe retries an event for
+			{Keys: bson.D{{Key: "received_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(30 * 24 * 60 * 60)},
+		},
+		"trusted_commenters": {
+			{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "user_uuid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		},
+	}
+
+	for collection, models := range indexes {
+		_, err := DB_Main.Collection(collection).Indexes().CreateMany(ctx, models)
+		if err != nil {
+			return fmt.Errorf("error creating %s indexes: %v", collection, err)
+		}
+	}
+
+	// emails are stored normalised, so the index keeps them one per account;
+	// every Stripe event looks its customer up here
+	userList := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "stripecustomerid", Value: 1}}},
+	}
+	if _, err := DB_UserList.Collection("users").Indexes().CreateMany(ctx, userList); err != nil {
+		return fmt.Errorf("error creating users indexes: %v", err)
+	}
+
+	return nil
 }
 func ensureStatsDocumentExists() error {
 	ctx := context.Background()
@@ -128,6 +210,42 @@ func GetTotalUserCount() error {
 	return nil
 }
 
+func GetTotalCommentCount() error {
+	ctx := context.Background()
+	// pending and spam comments are not shown, so they are not counted
+	filter := bson.M{"status": bson.M{"$nin": []string{"pending", "spam"}}}
+	count, err := DB_Main.Collection("comments").CountDocuments(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("error fetching comment count: %v", err)
+	}
+
+	// Update the stats document with the new comment count
+	_, err = DB_Main.Collection("stats").UpdateOne(
+		ctx,
+		bson.M{"_id": "stats"}, // Match the stats document
+		bson.M{"$set": bson.M{"comment_count": count}}, // Update the comment count
+	)
+	if err != nil {
+		return fmt.Errorf("error updating totalcomments: %v", err)
+	}
+
+	return nil
+}
+
+// IncrementStat adds n (which may be negative) to a counter in the stats document.
+func IncrementStat(field string, n int) error {
+	_, err := DB_Main.Collection("stats").UpdateOne(
+		context.Background(),
+		bson.M{"_id": "stats"},
+		bson.M{"$inc": bson.M{field: n}, "$set": bson.M{"last_updated": time.Now().Format(time.RFC3339)}},
+	)
+	if err != nil {
+		return fmt.Errorf("error updating %s: %v", field, err)
+	}
+
+	return nil
+}
+
 func GetStats() (bson.M, error) {
 	ctx := context.Background()
 	var stats bson.M
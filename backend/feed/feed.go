@@ -0,0 +1,406 @@
+package feed
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/blog"
+	"blogr.moe/backend/database"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	feedLimit     = 20
+	feedCacheTTL  = 5 * time.Minute
+	feedCacheSize = 512
+)
+
+// Feed is the format-independent content of a feed.
+type Feed struct {
+	Title   string
+	Link    string
+	Self    string
+	Updated time.Time
+	Posts   []blog.BlogPost
+}
+
+// errNotFound is returned by a feed's build when there is nothing to feed.
+var errNotFound = errors.New("not found")
+
+type cachedFeed struct {
+	body         []byte
+	etag         string
+	lastModified time.Time
+	expires      time.Time
+}
+
+// Feeds are cached in memory for feedCacheTTL so readers polling every few
+// minutes are answered without a query. At most feedCacheSize are kept, since
+// anyone can ask for the feed of a new tag.
+var (
+	cacheMu sync.Mutex
+	cache   = make(map[string]cachedFeed)
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Author     atomAuthor     `xml:"author"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Content    atomContent    `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	GUID        string       `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Author      string       `xml:"author"`
+	Categories  []string     `xml:"category"`
+	Description string       `xml:"description"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int    `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+func postURL(post blog.BlogPost) string {
+	return fmt.Sprintf("%s/u/%s/%s", auth.SiteURL(), post.Author, post.BlogID)
+}
+
+func imageURL(post blog.BlogPost) string {
+	return fmt.Sprintf("%s/i/%s/%s", auth.SiteURL(), post.Author, post.BlogID)
+}
+
+func parseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// postUpdated is the later of the post's Date and its last edit.
+func postUpdated(post blog.BlogPost) time.Time {
+	date := parseTime(post.Date)
+	if updated := parseTime(post.Updated); updated.After(date) {
+		return updated
+	}
+	return date
+}
+
+// loadFeed fetches the latest published posts from DB_Main.posts matching filter.
+func loadFeed(c echo.Context, filter bson.M) (*Feed, error) {
+	query := blog.PublishedFilter()
+	for key, value := range filter {
+		query[key] = value
+	}
+
+	findOptions := options.Find().SetSort(bson.M{"date": -1}).SetLimit(int64(feedLimit))
+	cursor, err := database.DB_Main.Collection("posts").Find(c.Request().Context(), query, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching posts: %v", err)
+	}
+
+	feed := &Feed{Posts: []blog.BlogPost{}}
+	if err := cursor.All(c.Request().Context(), &feed.Posts); err != nil {
+		return nil, fmt.Errorf("error decoding posts: %v", err)
+	}
+	for _, post := range feed.Posts {
+		if updated := postUpdated(post); updated.After(feed.Updated) {
+			feed.Updated = updated
+		}
+	}
+	return feed, nil
+}
+
+func renderAtom(feed *Feed) ([]byte, error) {
+	out := atomFeed{
+		Title:   feed.Title,
+		ID:      feed.Self,
+		Updated: feed.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: feed.Self, Rel: "self", Type: "application/atom+xml"},
+			{Href: feed.Link, Rel: "alternate", Type: "text/html"},
+		},
+	}
+	for _, post := range feed.Posts {
+		entry := atomEntry{
+			Title:     post.Title,
+			ID:        postURL(post),
+			Published: parseTime(post.Date).UTC().Format(time.RFC3339),
+			Updated:   postUpdated(post).UTC().Format(time.RFC3339),
+			Author:    atomAuthor{Name: post.Author, URI: auth.SiteURL() + "/u/" + post.Author},
+			Links: []atomLink{
+				{Href: postURL(post), Rel: "alternate", Type: "text/html"},
+				{Href: imageURL(post), Rel: "enclosure", Type: "image/jpeg"},
+			},
+			Content: atomContent{Type: "html", Body: post.Content},
+		}
+		for _, tag := range post.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		out.Entries = append(out.Entries, entry)
+	}
+	return marshal(out)
+}
+
+func renderRSS(feed *Feed) ([]byte, error) {
+	out := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         feed.Title,
+			Link:          feed.Link,
+			Description:   feed.Title,
+			LastBuildDate: feed.Updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, post := range feed.Posts {
+		out.Channel.Items = append(out.Channel.Items, rssItem{
+			Title:       post.Title,
+			Link:        postURL(post),
+			GUID:        postURL(post),
+			PubDate:     parseTime(post.Date).UTC().Format(time.RFC1123Z),
+			Author:      post.Author,
+			Categories:  post.Tags,
+			Description: post.Content,
+			Enclosure:   rssEnclosure{URL: imageURL(post), Type: "image/jpeg"},
+		})
+	}
+	return marshal(out)
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// serve answers a feed request from the cache when possible, honouring
+// If-None-Match and If-Modified-Since.
+func serve(c echo.Context, key string, contentType string, build func() (*Feed, error), render func(*Feed) ([]byte, error)) error {
+	cacheMu.Lock()
+	entry, ok := cache[key]
+	cacheMu.Unlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		feed, err := build()
+		if err == errNotFound {
+			return c.String(http.StatusNotFound, "Feed not found")
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Error building feed")
+		}
+		// a feed with no posts yet still needs an <updated>
+		if feed.Updated.IsZero() {
+			feed.Updated = time.Now()
+		}
+		body, err := render(feed)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Error building feed")
+		}
+		sum := sha256.Sum256(body)
+		entry = cachedFeed{
+			body:         body,
+			etag:         `"` + hex.EncodeToString(sum[:16]) + `"`,
+			lastModified: feed.Updated.UTC().Truncate(time.Second),
+			expires:      time.Now().Add(feedCacheTTL),
+		}
+		cacheMu.Lock()
+		storeFeed(key, entry)
+		cacheMu.Unlock()
+	}
+
+	header := c.Response().Header()
+	header.Set("ETag", entry.etag)
+	if !entry.lastModified.IsZero() {
+		header.Set("Last-Modified", entry.lastModified.Format(http.TimeFormat))
+	}
+	header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(feedCacheTTL.Seconds())))
+
+	if notModified(c.Request(), entry) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, contentType, entry.body)
+}
+
+// storeFeed caches a feed, dropping expired ones and then, if the cache is
+// still full, the one that expires first. cacheMu must be held.
+func storeFeed(key string, entry cachedFeed) {
+	now := time.Now()
+	for k, old := range cache {
+		if now.After(old.expires) {
+			delete(cache, k)
+		}
+	}
+	for len(cache) >= feedCacheSize {
+		oldest := ""
+		for k, old := range cache {
+			if oldest == "" || old.expires.Before(cache[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(cache, oldest)
+	}
+	cache[key] = entry
+}
+
+func notModified(r *http.Request, entry cachedFeed) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == entry.etag || tag == "W/"+entry.etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" && !entry.lastModified.IsZero() {
+		t, err := http.ParseTime(since)
+		return err == nil && !entry.lastModified.After(t)
+	}
+	return false
+}
+
+func contentType(format string) string {
+	if format == "rss" {
+		return "application/rss+xml; charset=utf-8"
+	}
+	return "application/atom+xml; charset=utf-8"
+}
+
+func renderer(format string) func(*Feed) ([]byte, error) {
+	if format == "rss" {
+		return renderRSS
+	}
+	return renderAtom
+}
+
+// SiteFeed serves the latest posts from the whole site.
+func SiteFeed(format string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		build := func() (*Feed, error) {
+			feed, err := loadFeed(c, bson.M{})
+			if err != nil {
+				return nil, err
+			}
+			feed.Title = "Blogr"
+			feed.Link = auth.SiteURL() + "/"
+			feed.Self = auth.SiteURL() + "/feed." + format
+			return feed, nil
+		}
+		return serve(c, "site."+format, contentType(format), build, renderer(format))
+	}
+}
+
+// UserFeed serves the latest posts of the author in :user. The user is only
+// looked up when the feed isn't cached.
+func UserFeed(format string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		username := c.Param("user")
+		build := func() (*Feed, error) {
+			user, err := auth.GetUserByUsername(username)
+			if err != nil {
+				return nil, errNotFound
+			}
+			feed, err := loadFeed(c, bson.M{"author": username})
+			if err != nil {
+				return nil, err
+			}
+			if feed.Updated.IsZero() {
+				feed.Updated, _ = time.Parse("2006-01-02 15:04:05", user.DateCreated)
+			}
+			feed.Title = username + " on Blogr"
+			feed.Link = auth.SiteURL() + "/u/" + username
+			feed.Self = feed.Link + "/feed." + format
+			return feed, nil
+		}
+		return serve(c, "user:"+username+"."+format, contentType(format), build, renderer(format))
+	}
+}
+
+// TagFeed serves the latest posts tagged with :tag.
+func TagFeed(format string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tag := strings.ToLower(strings.TrimSpace(c.Param("tag")))
+		if tag == "" {
+			return c.String(http.StatusNotFound, "Tag not found")
+		}
+		build := func() (*Feed, error) {
+			feed, err := loadFeed(c, blog.TagFilter(tag))
+			if err != nil {
+				return nil, err
+			}
+			feed.Title = "#" + tag + " on Blogr"
+			feed.Link = auth.SiteURL() + "/tag/" + tag
+			feed.Self = feed.Link + "/feed." + format
+			return feed, nil
+		}
+		return serve(c, "tag:"+tag+"."+format, contentType(format), build, renderer(format))
+	}
+}
@@ -5,14 +5,15 @@ import (
 	"html/template"
 	"net/http"
 	"path/filepath"
+	"time"
 
+	"blogr.moe/backend/account"
+	"blogr.moe/backend/auth"
 	"blogr.moe/backend/blog"
-	"github.com/labstack/echo-contrib/session"
+	"blogr.moe/backend/search"
 	"github.com/labstack/echo/v4"
 )
 
-var data = make(map[string]interface{})
-
 func Home(c echo.Context) error {
 	// Get all partial templates
 	partials, err := filepath.Glob("views/partials/*.html")
@@ -29,10 +30,9 @@ func Home(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
+	data := GlobalData(c)
 	data["PageName"] = "Home"
 
-	GlobalData(c)
-
 	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
 	if err != nil {
 		fmt.Println("Error executing template:", err)
@@ -58,8 +58,65 @@ func Login(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
+	data := GlobalData(c)
 	data["PageName"] = "Login"
-	GlobalData(c)
+
+	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
+	if err != nil {
+		fmt.Println("Error executing template:", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return nil
+}
+
+func ForgotPassword(c echo.Context) error {
+	// Get all partial templates
+	partials, err := filepath.Glob("views/partials/*.html")
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	// Add base and home templates to the list
+	files := append([]string{"views/base.html", "views/forgot-password.html"}, partials...)
+
+	// Parse all templates
+	tmpl, err := template.ParseFiles(files...)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	data := GlobalData(c)
+	data["PageName"] = "Forgot Password"
+
+	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
+	if err != nil {
+		fmt.Println("Error executing template:", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return nil
+}
+
+func ResetPassword(c echo.Context) error {
+	// Get all partial templates
+	partials, err := filepath.Glob("views/partials/*.html")
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	// Add base and home templates to the list
+	files := append([]string{"views/base.html", "views/reset-password.html"}, partials...)
+
+	// Parse all templates
+	tmpl, err := template.ParseFiles(files...)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	data := GlobalData(c)
+	data["PageName"] = "Reset Password"
+	data["ResetToken"] = c.QueryParam("token")
 
 	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
 	if err != nil {
@@ -86,8 +143,71 @@ func Register(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
+	data := GlobalData(c)
 	data["PageName"] = "Register"
-	GlobalData(c)
+
+	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
+	if err != nil {
+		fmt.Println("Error executing template:", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return nil
+}
+
+func Admin(c echo.Context) error {
+	// Get all partial templates
+	partials, err := filepath.Glob("views/partials/*.html")
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	// Add base and home templates to the list
+	files := append([]string{"views/base.html", "views/admin.html"}, partials...)
+
+	// Parse all templates
+	tmpl, err := template.ParseFiles(files...)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	data := GlobalData(c)
+	data["PageName"] = "Admin"
+
+	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
+	if err != nil {
+		fmt.Println("Error executing template:", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return nil
+}
+
+func Billing(c echo.Context) error {
+	// Get all partial templates
+	partials, err := filepath.Glob("views/partials/*.html")
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	// Add base and home templates to the list
+	files := append([]string{"views/base.html", "views/user/billing.html"}, partials...)
+
+	// Parse all templates
+	tmpl, err := template.ParseFiles(files...)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	data := GlobalData(c)
+	data["PageName"] = "Billing"
+
+	user := auth.GetUserFromContext(c)
+	data["PremiumActive"] = user.PremiumActive()
+	data["PremiumUntil"] = ""
+	if expiry, err := time.Parse(time.RFC3339, user.PremiumExpiry); err == nil {
+		data["PremiumUntil"] = expiry.Format("January 2, 2006")
+	}
 
 	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
 	if err != nil {
@@ -114,8 +234,18 @@ func Dashboard(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
+	data := GlobalData(c)
 	data["PageName"] = "Dashboard"
-	GlobalData(c)
+
+	pending, err := blog.GetPendingComments(c.Request().Context(), auth.GetUserFromContext(c).Username)
+	if err != nil {
+		fmt.Println("Error fetching pending comments:", err)
+	}
+	data["PendingComments"] = pending
+	data["EmailVerified"] = auth.GetUserFromContext(c).VerifiedEmail
+	data["TwoFactorEnabled"] = auth.GetUserFromContext(c).TOTPEnabled
+	data["JustVerified"] = c.QueryParam("verified") == "1"
+	data["PendingDeletion"] = account.PendingDeletion(c.Request().Context(), auth.GetUserFromContext(c).UUID)
 
 	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
 	if err != nil {
@@ -142,8 +272,8 @@ func Premium(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
+	data := GlobalData(c)
 	data["PageName"] = "Premium"
-	GlobalData(c)
 
 	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
 	if err != nil {
@@ -170,8 +300,8 @@ func UserDashboard(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
+	data := GlobalData(c)
 	data["PageName"] = "Dashboard"
-	GlobalData(c)
 
 	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
 	if err != nil {
@@ -198,10 +328,21 @@ func SinglePost(c echo.Context, user string, id string) error {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 
+	data := GlobalData(c)
 	data["PageName"] = "Post"
 	post, err := blog.GetPost(c, user, id)
+	if err != nil {
+		return c.String(http.StatusNotFound, "Post not found")
+	}
+	blog.RecordView(c, post)
 	data["Post"] = post
-	GlobalData(c)
+	comments, err := blog.GetComments(c.Request().Context(), post.Author, post.BlogID)
+	if err != nil {
+		fmt.Println("Error fetching comments:", err)
+	}
+	data["Comments"] = comments
+	data["CommentPolicy"] = blog.CommentPolicyFor(post)
+	data["CanDeletePost"] = auth.GetUserFromContext(c).Can(auth.PermPostsDeleteAny)
 
 	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
 	if err != nil {
@@ -212,13 +353,174 @@ func SinglePost(c echo.Context, user string, id string) error {
 	return nil
 }
 
-func GlobalData(c echo.Context) map[string]interface{} {
-	session, err := session.Get("session", c)
+func Profile(c echo.Context, username string) error {
+	// Get all partial templates
+	partials, err := filepath.Glob("views/partials/*.html")
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	// Add base and profile templates to the list
+	files := append([]string{"views/base.html", "views/user/profile.html"}, partials...)
+
+	// Parse all templates
+	tmpl, err := template.ParseFiles(files...)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	author, err := auth.GetUserByUsername(username)
+	if err != nil {
+		return c.String(http.StatusNotFound, "User not found")
+	}
+
+	page, limit, skip := blog.Paginate(c)
+	if limit > 50 {
+		limit = 50
+		skip = (page - 1) * limit
+	}
+	posts, total, err := blog.GetAuthorPosts(c.Request().Context(), author.Username, limit, skip)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	data := GlobalData(c)
+	data["PageName"] = "Profile"
+	// only the public fields of the author are handed to the template
+	data["Profile"] = author.Public()
+	data["Posts"] = posts
+	data["TotalPosts"] = total
+	data["Page"] = page
+	data["Limit"] = limit
+	data["PrevPage"] = page - 1
+	data["NextPage"] = 0
+	if int64(skip+limit) < total {
+		data["NextPage"] = page + 1
+	}
+
+	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
+	if err != nil {
+		fmt.Println("Error executing template:", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return nil
+}
+
+func Tag(c echo.Context, tag string) error {
+	// Get all partial templates
+	partials, err := filepath.Glob("views/partials/*.html")
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	// Add base and tag templates to the list
+	files := append([]string{"views/base.html", "views/blog/tag.html"}, partials...)
+
+	// Parse all templates
+	tmpl, err := template.ParseFiles(files...)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	tag = blog.NormalizeTag(tag)
+	if tag == "" {
+		return c.String(http.StatusNotFound, "Tag not found")
+	}
+
+	page, limit, skip := blog.Paginate(c)
+	if limit > 50 {
+		limit = 50
+		skip = (page - 1) * limit
+	}
+	posts, total, err := blog.GetTagPosts(c.Request().Context(), tag, limit, skip)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	cloud, err := blog.GetTagCounts(c.Request().Context(), 50)
+	if err != nil {
+		fmt.Println("Error fetching tags:", err)
+	}
+
+	data := GlobalData(c)
+	data["PageName"] = "Tag"
+	data["Tag"] = tag
+	data["TagCloud"] = cloud
+	data["Posts"] = posts
+	data["TotalPosts"] = total
+	data["Page"] = page
+	data["Limit"] = limit
+	data["PrevPage"] = page - 1
+	data["NextPage"] = 0
+	if int64(skip+limit) < total {
+		data["NextPage"] = page + 1
+	}
+
+	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
+	if err != nil {
+		fmt.Println("Error executing template:", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return nil
+}
+
+func Search(c echo.Context) error {
+	// Get all partial templates
+	partials, err := filepath.Glob("views/partials/*.html")
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	// Add base and search templates to the list
+	files := append([]string{"views/base.html", "views/search.html"}, partials...)
+
+	// Parse all templates
+	tmpl, err := template.ParseFiles(files...)
 	if err != nil {
-		// Handle error appropriately
-		return nil
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	data := GlobalData(c)
+	data["PageName"] = "Search"
+	data["SearchError"] = ""
+	q, err := search.ParseQuery(c)
+	if err != nil {
+		data["SearchError"] = err.Error()
+	}
+	results, err := search.Run(c.Request().Context(), q)
+	if err != nil {
+		data["SearchError"] = "Error searching posts"
+		results = &search.Results{Query: q.Text, Page: q.Page, Limit: q.Limit}
+	}
+	data["Search"] = results
+	data["SearchAuthor"] = c.QueryParam("author")
+	data["SearchFrom"] = c.QueryParam("from")
+	data["SearchTo"] = c.QueryParam("to")
+	data["PrevPage"] = q.Page - 1
+	data["NextPage"] = 0
+	if q.Page*q.Limit < results.Total {
+		data["NextPage"] = q.Page + 1
+	}
+
+	err = tmpl.ExecuteTemplate(c.Response().Writer, "base.html", data)
+	if err != nil {
+		fmt.Println("Error executing template:", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return nil
+}
+
+// GlobalData returns a new page data map for the request, holding what every
+// page needs.
+func GlobalData(c echo.Context) map[string]interface{} {
+	data := make(map[string]interface{})
+	// templates check {{if .User}}, so logged out visitors get nil
+	data["User"] = nil
+	if user := auth.GetUserFromContext(c); user.UUID != "" {
+		data["User"] = user.Page()
 	}
-	data["User"] = session.Values["user"]
 
 	return data
 }
@@ -3,10 +3,14 @@ package routes
 import (
 	"net/http"
 
+	"blogr.moe/backend/account"
+	"blogr.moe/backend/admin"
 	auth "blogr.moe/backend/auth"
 	"blogr.moe/backend/blog"
 	"blogr.moe/backend/database"
+	"blogr.moe/backend/feed"
 	"blogr.moe/backend/home"
+	"blogr.moe/backend/search"
 	"blogr.moe/backend/stripe"
 	"github.com/labstack/echo/v4"
 )
@@ -28,6 +32,14 @@ func RegisterRoutes(e *echo.Echo) {
 		return home.Register(c)
 	})
 
+	e.GET("/forgot-password", func(c echo.Context) error {
+		return home.ForgotPassword(c)
+	})
+
+	e.GET("/reset-password", func(c echo.Context) error {
+		return home.ResetPassword(c)
+	})
+
 	e.GET("/dashboard", func(c echo.Context) error {
 		if !auth.IsLoggedIn(c) {
 			return c.Redirect(302, "/login")
@@ -35,10 +47,28 @@ func RegisterRoutes(e *echo.Echo) {
 		return home.Dashboard(c)
 	})
 
+	e.GET("/billing", func(c echo.Context) error {
+		if !auth.IsLoggedIn(c) {
+			return c.Redirect(302, "/login")
+		}
+		return home.Billing(c)
+	})
+
+	e.GET("/admin", func(c echo.Context) error {
+		if !auth.GetUserFromContext(c).Can(auth.PermUsersManage) {
+			return c.String(http.StatusNotFound, "Not Found")
+		}
+		return home.Admin(c)
+	})
+
 	e.GET("/premium", func(c echo.Context) error {
 		return home.Premium(c)
 	})
 
+	e.GET("/search", func(c echo.Context) error {
+		return home.Search(c)
+	})
+
 	// Static files
 	e.Static("/assets", "assets")
 
@@ -48,20 +78,71 @@ func RegisterRoutes(e *echo.Echo) {
 		return auth.Register(c)
 	})
 	e.GET("/api/auth/logout", auth.Logout)
+	e.POST("/api/auth/forgot-password", auth.ForgotPassword)
+	e.POST("/api/auth/reset-password", auth.ResetPassword)
+	e.GET("/verify-email", auth.VerifyEmail)
+	e.POST("/api/auth/2fa", auth.LoginTwoFactor)
+	e.POST("/api/user/2fa/setup", auth.SetupTwoFactor)
+	e.POST("/api/user/2fa/confirm", auth.ConfirmTwoFactor)
+	e.POST("/api/user/2fa/disable", auth.DisableTwoFactor)
+	e.POST("/api/user/2fa/recovery-codes", auth.RegenerateRecoveryCodes)
+	e.GET("/api/user/sessions", auth.ListSessions)
+	e.DELETE("/api/user/sessions", auth.RevokeOtherSessions)
+	e.DELETE("/api/user/sessions/:id", auth.RevokeSession)
+	e.GET("/api/user/tokens", auth.ListTokens)
+	e.POST("/api/user/tokens", auth.CreateToken)
+	e.DELETE("/api/user/tokens/:id", auth.RevokeToken)
+	e.POST("/api/auth/verify/resend", auth.ResendVerification)
+	e.PUT("/api/user/settings", auth.UpdateUser)
+	e.PUT("/api/user/settings/email", auth.ChangeEmail)
+	e.PUT("/api/user/settings/username", account.ChangeUsername)
+	e.PUT("/api/user/settings/password", auth.ChangePassword)
+	e.POST("/api/user/deletion", account.RequestDeletion)
+	e.DELETE("/api/user/deletion", account.CancelDeletion)
+	e.POST("/api/user/export", account.RequestExport)
+	e.GET("/api/user/export/:token", account.DownloadExport)
+
+	e.POST("/api/user/post", blog.NewBlogHandler, auth.TokenScope(auth.ScopePostsWrite), auth.Require(auth.PermPostsCreate))
+	e.GET("/api/user/posts", blog.GetLatestPostsUser, auth.TokenScope(auth.ScopePostsRead))
+	e.GET("/api/user/analytics", blog.GetUserAnalytics, auth.TokenScope(auth.ScopeAnalyticsRead))
 
-	e.POST("/api/user/post", blog.NewBlogHandler)
-	e.GET("/api/user/posts", blog.GetLatestPostsUser)
+	e.GET("/feed.atom", feed.SiteFeed("atom"))
+	e.GET("/feed.rss", feed.SiteFeed("rss"))
+	e.GET("/u/:user/feed.atom", feed.UserFeed("atom"), account.RedirectRenamed)
+	e.GET("/u/:user/feed.rss", feed.UserFeed("rss"), account.RedirectRenamed)
+	e.GET("/tag/:tag/feed.atom", feed.TagFeed("atom"))
+	e.GET("/tag/:tag/feed.rss", feed.TagFeed("rss"))
 
+	e.GET("/tag/:tag", func(c echo.Context) error {
+		return home.Tag(c, c.Param("tag"))
+	})
+	e.GET("/api/tags", blog.GetTagCloud)
+	e.GET("/api/search", search.Search)
+	e.GET("/u/:user", func(c echo.Context) error {
+		return home.Profile(c, c.Param("user"))
+	}, account.RedirectRenamed)
 	e.GET("/u/:user/:id", func(c echo.Context) error {
 		user := c.Param("user")
 		id := c.Param("id")
 		return home.SinglePost(c, user, id)
-	})
+	}, account.RedirectRenamed)
 	e.GET("/i/:user/:postid", func(c echo.Context) error {
 		return blog.GetPostImage(c)
-	})
-	e.POST("/api/blog", blog.NewBlogHandler)
-	e.DELETE("/api/user/blog/:id", blog.DeleteUserPost)
+	}, account.RedirectRenamed)
+	e.POST("/api/blog", blog.NewBlogHandler, auth.TokenScope(auth.ScopePostsWrite), auth.Require(auth.PermPostsCreate))
+	e.DELETE("/api/user/blog/:id", blog.DeleteUserPost, auth.TokenScope(auth.ScopePostsWrite), auth.Require(auth.PermPostsDeleteOwn))
+	e.DELETE("/api/blog/:user/:id", blog.DeletePost, auth.Require(auth.PermPostsDeleteAny))
+	e.PUT("/api/user/blog/:id", blog.UpdateUserPost, auth.TokenScope(auth.ScopePostsWrite), auth.Require(auth.PermPostsEditOwn))
+	e.GET("/api/user/blog/:id/revisions", blog.ListRevisions, auth.TokenScope(auth.ScopePostsRead))
+	e.GET("/api/user/blog/:id/revisions/:rev", blog.DiffRevision, auth.TokenScope(auth.ScopePostsRead))
+	e.POST("/api/user/blog/:id/revisions/:rev/restore", blog.RestoreRevision, auth.TokenScope(auth.ScopePostsWrite), auth.Require(auth.PermPostsEditOwn))
+	e.GET("/api/blog/:user/:id/comments", blog.ListComments)
+	e.POST("/api/blog/:user/:id/comments", blog.NewComment)
+	e.PUT("/api/comments/:id", blog.EditComment)
+	e.DELETE("/api/comments/:id", blog.DeleteComment)
+	e.GET("/api/user/comments/pending", blog.ListPendingComments)
+	e.POST("/api/user/comments/:id/:action", blog.ModerateComment)
+	e.PUT("/api/user/comment-policy", blog.UpdateCommentPolicy)
 	e.GET("/api/stats", func(c echo.Context) error {
 		stats, err := database.GetStats()
 		if err != nil {
@@ -69,7 +150,24 @@ func RegisterRoutes(e *echo.Echo) {
 		}
 		return c.JSON(http.StatusOK, stats)
 	})
+
+	a := e.Group("/api/admin", auth.Require(auth.PermUsersManage))
+	a.GET("/users", admin.SearchUsers)
+	a.POST("/users/:uuid/suspend", admin.SuspendUser)
+	a.DELETE("/users/:uuid/suspend", admin.UnsuspendUser)
+	a.POST("/users/:uuid/premium", admin.GrantPremium)
+	a.DELETE("/users/:uuid/premium", admin.RevokePremium)
+	a.PUT("/users/:uuid/role", admin.SetRole)
+	a.GET("/stats", admin.GetStats, auth.Require(auth.PermSiteManage))
+	a.POST("/stats/recompute", admin.RecomputeStats, auth.Require(auth.PermSiteManage))
+	a.GET("/health", admin.Health, auth.Require(auth.PermSiteManage))
+
 	e.GET("/api/stripe/checkout", stripe.GetCheckoutSession)
 	e.GET("/api/stripe/success", stripe.CheckoutSuccessHandler)
+	e.POST("/api/stripe/webhook", stripe.Webhook)
+	e.POST("/api/stripe/subscription/cancel", stripe.CancelSubscription)
+	e.POST("/api/stripe/subscription/resume", stripe.ResumeSubscription)
+	e.POST("/api/stripe/portal", stripe.GetPortalSession)
+	e.GET("/api/stripe/payments", stripe.ListPayments)
 
 }
@@ -0,0 +1,155 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"blogr.moe/backend/blog"
+	"blogr.moe/backend/database"
+)
+
+// Field weights mirror the weights of the MongoDB text index.
+var (
+	titleWeight   = 10.0
+	tagWeight     = 5.0
+	contentWeight = 1.0
+)
+
+// MemoryIndex is an in-process inverted index over published posts, used when
+// MongoDB text search is unavailable.
+type MemoryIndex struct {
+	mu       sync.RWMutex
+	posts    map[string]blog.BlogPost
+	postings map[string]map[string]float64 // term -> post key -> weighted frequency
+}
+
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{
+		posts:    make(map[string]blog.BlogPost),
+		postings: make(map[string]map[string]float64),
+	}
+}
+
+func postKey(post blog.BlogPost) string {
+	return post.Author + "/" + post.BlogID
+}
+
+// Rebuild replaces the index with the current published posts in DB_Main.posts.
+func (m *MemoryIndex) Rebuild(ctx context.Context) error {
+	cursor, err := database.DB_Main.Collection("posts").Find(ctx, blog.PublishedFilter())
+	if err != nil {
+		return fmt.Errorf("error fetching posts: %v", err)
+	}
+	var posts []blog.BlogPost
+	if err := cursor.All(ctx, &posts); err != nil {
+		return fmt.Errorf("error decoding posts: %v", err)
+	}
+
+	fresh := NewMemoryIndex()
+	for _, post := range posts {
+		fresh.Add(post)
+	}
+
+	m.mu.Lock()
+	m.posts = fresh.posts
+	m.postings = fresh.postings
+	m.mu.Unlock()
+	return nil
+}
+
+// Add indexes a post, replacing any previous version of it.
+func (m *MemoryIndex) Add(post blog.BlogPost) {
+	m.Remove(post)
+
+	key := postKey(post)
+	weights := make(map[string]float64)
+	for _, term := range Tokenize(post.Title) {
+		weights[term] += titleWeight
+	}
+	for _, tag := range post.Tags {
+		for _, term := range Tokenize(tag) {
+			weights[term] += tagWeight
+		}
+	}
+	for _, term := range Tokenize(StripHTML(post.Content)) {
+		weights[term] += contentWeight
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.posts[key] = post
+	for term, weight := range weights {
+		if m.postings[term] == nil {
+			m.postings[term] = make(map[string]float64)
+		}
+		m.postings[term][key] = weight
+	}
+}
+
+// Remove drops a post from the index.
+func (m *MemoryIndex) Remove(post blog.BlogPost) {
+	key := postKey(post)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.posts[key]; !ok {
+		return
+	}
+	delete(m.posts, key)
+	for term, docs := range m.postings {
+		delete(docs, key)
+		if len(docs) == 0 {
+			delete(m.postings, term)
+		}
+	}
+}
+
+// Search scores posts containing any of the query terms with a weighted tf-idf.
+func (m *MemoryIndex) Search(ctx context.Context, q Query) ([]Result, int, error) {
+	terms := Tokenize(q.Text)
+
+	m.mu.RLock()
+	scores := make(map[string]float64)
+	total := float64(len(m.posts))
+	for _, term := range terms {
+		docs := m.postings[term]
+		if len(docs) == 0 {
+			continue
+		}
+		idf := math.Log(1 + total/float64(len(docs)))
+		for key, weight := range docs {
+			if q.matches(m.posts[key]) {
+				scores[key] += (1 + math.Log(weight)) * idf
+			}
+		}
+	}
+	matches := make([]Result, 0, len(scores))
+	for key, score := range scores {
+		matches = append(matches, Result{Post: m.posts[key], Score: score})
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Post.Date > matches[j].Post.Date
+	})
+
+	from := (q.Page - 1) * q.Limit
+	if from > len(matches) {
+		from = len(matches)
+	}
+	to := from + q.Limit
+	if to > len(matches) {
+		to = len(matches)
+	}
+	page := matches[from:to]
+	for i := range page {
+		page[i].Snippet = Snippet(page[i].Post.Content, terms)
+	}
+	return page, len(matches), nil
+}
@@ -0,0 +1,325 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"blogr.moe/backend/blog"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	snippetRadius = 80
+	maxLimit      = 50
+)
+
+// Query is a parsed search request.
+type Query struct {
+	Text   string
+	Author string
+	From   time.Time
+	To     time.Time
+	Page   int
+	Limit  int
+}
+
+type Result struct {
+	Post    blog.BlogPost `json:"post"`
+	Score   float64       `json:"score"`
+	Snippet template.HTML `json:"snippet"`
+}
+
+type Results struct {
+	Query   string   `json:"query"`
+	Total   int      `json:"total"`
+	Page    int      `json:"page"`
+	Limit   int      `json:"limit"`
+	Results []Result `json:"results"`
+}
+
+// Engine runs a query against an index of published posts. Results are
+// ordered by relevance and already paginated; the int is the total number of matches.
+type Engine interface {
+	Search(ctx context.Context, q Query) ([]Result, int, error)
+}
+
+// Default is the engine used by the handlers. Init replaces it with the
+// in-process index when MongoDB text search isn't available.
+var Default Engine = &MongoEngine{}
+
+// Init creates the text index on DB_Main.posts. When that fails, or when
+// SEARCH_BACKEND=memory is set, search falls back to an in-process index.
+func Init() {
+	if os.Getenv("SEARCH_BACKEND") == "memory" {
+		useMemory()
+		return
+	}
+
+	model := mongo.IndexModel{
+		Keys: bson.D{{Key: "title", Value: "text"}, {Key: "tags", Value: "text"}, {Key: "content", Value: "text"}},
+		Options: options.Index().
+			SetName("posts_text").
+			SetWeights(bson.D{{Key: "title", Value: 10}, {Key: "tags", Value: 5}, {Key: "content", Value: 1}}),
+	}
+	_, err := database.DB_Main.Collection("posts").Indexes().CreateOne(context.Background(), model)
+	if err != nil {
+		logs.Warn("Text search unavailable, using in-process index:", err)
+		useMemory()
+	}
+}
+
+func useMemory() {
+	index := NewMemoryIndex()
+	if err := index.Rebuild(context.Background()); err != nil {
+		logs.Error("Error building search index:", err)
+	}
+	Default = index
+}
+
+// Refresh rebuilds the in-process index if it is in use. It is run by the scheduler.
+func Refresh() {
+	if index, ok := Default.(*MemoryIndex); ok {
+		if err := index.Rebuild(context.Background()); err != nil {
+			logs.Error("Error rebuilding search index:", err)
+		}
+	}
+}
+
+// MongoEngine searches DB_Main.posts using its text index.
+type MongoEngine struct{}
+
+func (m *MongoEngine) Search(ctx context.Context, q Query) ([]Result, int, error) {
+	filter := blog.PublishedFilter()
+	filter["$text"] = bson.M{"$search": q.Text}
+	for key, value := range q.filters() {
+		filter[key] = value
+	}
+
+	total, err := database.DB_Main.Collection("posts").CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error counting results: %v", err)
+	}
+
+	findOptions := options.Find().
+		SetProjection(bson.M{"score": bson.M{"$meta": "textScore"}}).
+		SetSort(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "date", Value: -1}}).
+		SetSkip(int64((q.Page - 1) * q.Limit)).
+		SetLimit(int64(q.Limit))
+	cursor, err := database.DB_Main.Collection("posts").Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching posts: %v", err)
+	}
+
+	var docs []struct {
+		blog.BlogPost `bson:",inline"`
+		Score         float64 `bson:"score"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, 0, fmt.Errorf("error decoding results: %v", err)
+	}
+
+	terms := Tokenize(q.Text)
+	results := make([]Result, 0, len(docs))
+	for _, doc := range docs {
+		results = append(results, Result{Post: doc.BlogPost, Score: doc.Score, Snippet: Snippet(doc.Content, terms)})
+	}
+	return results, int(total), nil
+}
+
+// filters are the author and date restrictions of a MongoDB search, the same
+// as matches. Dates are stored as RFC3339 strings in whatever offset the
+// server had, so they are parsed before comparing rather than compared as text.
+func (q Query) filters() bson.M {
+	filter := bson.M{}
+	if q.Author != "" {
+		filter["author"] = q.Author
+	}
+	if q.From.IsZero() && q.To.IsZero() {
+		return filter
+	}
+	date := bson.M{"$dateFromString": bson.M{"dateString": "$date", "onError": nil, "onNull": nil}}
+	// posts with no readable date don't match a date range
+	conditions := []bson.M{{"$ne": bson.A{date, nil}}}
+	if !q.From.IsZero() {
+		conditions = append(conditions, bson.M{"$gte": bson.A{date, q.From.UTC()}})
+	}
+	if !q.To.IsZero() {
+		conditions = append(conditions, bson.M{"$lte": bson.A{date, q.To.UTC()}})
+	}
+	filter["$expr"] = bson.M{"$and": conditions}
+	return filter
+}
+
+func (q Query) matches(post blog.BlogPost) bool {
+	if q.Author != "" && post.Author != q.Author {
+		return false
+	}
+	if q.From.IsZero() && q.To.IsZero() {
+		return true
+	}
+	date, err := time.Parse(time.RFC3339, post.Date)
+	if err != nil {
+		return false
+	}
+	if !q.From.IsZero() && date.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && date.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// ParseQuery reads q, author, from, to, page and limit from the request.
+// Dates may be RFC3339 times or plain YYYY-MM-DD days.
+func ParseQuery(c echo.Context) (Query, error) {
+	page, limit, _ := blog.Paginate(c)
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	q := Query{
+		Text:   strings.TrimSpace(c.QueryParam("q")),
+		Author: strings.TrimSpace(c.QueryParam("author")),
+		Page:   page,
+		Limit:  limit,
+	}
+
+	var err error
+	if q.From, err = parseDate(c.QueryParam("from"), false); err != nil {
+		return q, fmt.Errorf("invalid from date")
+	}
+	if q.To, err = parseDate(c.QueryParam("to"), true); err != nil {
+		return q, fmt.Errorf("invalid to date")
+	}
+	return q, nil
+}
+
+func parseDate(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Second)
+	}
+	return t, nil
+}
+
+// Run executes a query with the default engine.
+func Run(ctx context.Context, q Query) (*Results, error) {
+	results := &Results{Query: q.Text, Page: q.Page, Limit: q.Limit, Results: []Result{}}
+	if len(Tokenize(q.Text)) == 0 {
+		return results, nil
+	}
+
+	found, total, err := Default.Search(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	results.Results = found
+	results.Total = total
+	return results, nil
+}
+
+func Search(c echo.Context) error {
+	q, err := ParseQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	results, err := Run(c.Request().Context(), q)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error searching posts"})
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// StripHTML turns post content into plain text.
+func StripHTML(content string) string {
+	text := tagPattern.ReplaceAllString(content, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+}
+
+// Tokenize splits text into lowercased words.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Snippet returns an escaped excerpt of the content around the first matching
+// term, with every matching word wrapped in <mark>.
+func Snippet(content string, terms []string) template.HTML {
+	text := []rune(StripHTML(content))
+	lower := []rune(strings.ToLower(string(text)))
+
+	start := 0
+	for _, term := range terms {
+		if i := strings.Index(string(lower), term); i >= 0 {
+			start = len([]rune(string(lower)[:i]))
+			break
+		}
+	}
+
+	from := start - snippetRadius
+	if from < 0 {
+		from = 0
+	}
+	to := start + snippetRadius
+	if to > len(text) {
+		to = len(text)
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	b.WriteString(highlight(string(text[from:to]), terms))
+	if to < len(text) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
+
+func highlight(text string, terms []string) string {
+	if len(terms) == 0 {
+		return html.EscapeString(text)
+	}
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	pattern := regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+
+	var b strings.Builder
+	last := 0
+	for _, loc := range pattern.FindAllStringIndex(text, -1) {
+		b.WriteString(html.EscapeString(text[last:loc[0]]))
+		b.WriteString("<mark>" + html.EscapeString(text[loc[0]:loc[1]]) + "</mark>")
+		last = loc[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
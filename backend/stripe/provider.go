@@ -0,0 +1,79 @@
+package stripe
+
+import (
+	"errors"
+	"os"
+
+	"github.com/stripe/stripe-go/v79"
+	portalsession "github.com/stripe/stripe-go/v79/billingportal/session"
+	"github.com/stripe/stripe-go/v79/checkout/session"
+	"github.com/stripe/stripe-go/v79/subscription"
+	"github.com/stripe/stripe-go/v79/webhook"
+)
+
+// Provider is the part of Stripe the handlers use. The live one talks to the
+// Stripe API; stripetest.Fake stands in for it without a network.
+type Provider interface {
+	NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+	GetCheckoutSession(id string) (*stripe.CheckoutSession, error)
+	GetSubscription(id string) (*stripe.Subscription, error)
+	UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	CancelSubscription(id string) (*stripe.Subscription, error)
+	NewPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error)
+	// ConstructEvent checks a webhook's Stripe-Signature header and parses it.
+	ConstructEvent(payload []byte, header string) (stripe.Event, error)
+}
+
+var provider Provider = liveProvider{}
+
+// SetProvider replaces the Stripe API, e.g. with a stripetest.Fake, and
+// returns the one it replaced.
+func SetProvider(p Provider) Provider {
+	previous := provider
+	provider = p
+	return previous
+}
+
+// liveProvider calls the Stripe API with STRIPE_SECRET. Events are signed with
+// STRIPE_WEBHOOK_SECRET.
+type liveProvider struct{}
+
+func (liveProvider) NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	stripe.Key = os.Getenv("STRIPE_SECRET")
+	return session.New(params)
+}
+
+func (liveProvider) GetCheckoutSession(id string) (*stripe.CheckoutSession, error) {
+	stripe.Key = os.Getenv("STRIPE_SECRET")
+	return session.Get(id, nil)
+}
+
+func (liveProvider) GetSubscription(id string) (*stripe.Subscription, error) {
+	stripe.Key = os.Getenv("STRIPE_SECRET")
+	return subscription.Get(id, nil)
+}
+
+func (liveProvider) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	stripe.Key = os.Getenv("STRIPE_SECRET")
+	return subscription.Update(id, params)
+}
+
+func (liveProvider) CancelSubscription(id string) (*stripe.Subscription, error) {
+	stripe.Key = os.Getenv("STRIPE_SECRET")
+	return subscription.Cancel(id, nil)
+}
+
+func (liveProvider) NewPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error) {
+	stripe.Key = os.Getenv("STRIPE_SECRET")
+	return portalsession.New(params)
+}
+
+func (liveProvider) ConstructEvent(payload []byte, header string) (stripe.Event, error) {
+	// stripe-go would check against an empty key rather than fail
+	secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if secret == "" {
+		return stripe.Event{}, errors.New("STRIPE_WEBHOOK_SECRET is not set")
+	}
+	return webhook.ConstructEventWithOptions(payload, header, secret,
+		webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+}
@@ -4,79 +4,89 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"time"
 
 	"blogr.moe/backend/auth"
-	"blogr.moe/backend/database"
 	"github.com/labstack/echo/v4"
 	"github.com/stripe/stripe-go/v79"
-	"github.com/stripe/stripe-go/v79/checkout/session"
-	"github.com/stripe/stripe-go/v79/customer"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
+// CheckoutSuccessHandler is where Stripe sends the browser after paying. The
+// webhook normally gets there first; this only catches up if it hasn't, and
+// only for the user the session was created for.
 func CheckoutSuccessHandler(c echo.Context) error {
-	stripe.Key = os.Getenv("STRIPE_SECRET")
+	user := auth.GetUserFromContext(c)
+	if user.UUID == "" {
+		return c.Redirect(http.StatusFound, "/login")
+	}
 	checkoutID := c.QueryParam("checkout_id")
 	if checkoutID == "" {
 		return c.JSON(400, map[string]string{"error": "Invalid checkout ID"})
 	}
 
-	sess, err := session.Get(checkoutID, nil)
+	sess, err := provider.GetCheckoutSession(checkoutID)
 	if err != nil {
 		return c.JSON(500, map[string]string{"error": "Error retrieving session"})
 	}
-
-	if sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid {
-		return c.JSON(400, map[string]string{"error": "Payment not completed"})
+	if sess.ClientReferenceID != user.UUID {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "This checkout belongs to another account"})
 	}
-
-	cust, err := customer.Get(sess.Customer.ID, nil)
-	if err != nil {
-		return c.JSON(500, map[string]string{"error": "Error fetching customer details"})
-	}
-
-	if cust.Email == "" {
-		return c.JSON(400, map[string]string{"error": "Invalid email"})
+	if sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid &&
+		sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusNoPaymentRequired {
+		return c.JSON(400, map[string]string{"error": "Payment not completed"})
 	}
 
-	user, _ := auth.GetUserByEmail(cust.Email)
-
-	user.Premium = true
-	user.PremiumExpiry = time.Now().AddDate(0, 1, 0).Format(time.RFC3339)
-
-	filter := bson.M{"uuid": user.UUID}
-	update := bson.M{"$set": user}
-
-	_, err = database.DB_Users.Collection("users").UpdateOne(c.Request().Context(), filter, update)
-	if err != nil {
-		log.Println("Error updating user:", err)
+	if err := fulfillCheckout(c.Request().Context(), sess); err != nil {
+		log.Println("Error fulfilling checkout:", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
 	}
 	return c.Redirect(301, os.Getenv("FRONTEND_URL")+"/")
 }
 
+// GetCheckoutSession starts a subscription checkout for ?plan=monthly (the
+// default) or ?plan=yearly and returns the session's ID and URL.
 func GetCheckoutSession(c echo.Context) error {
-	stripe.Key = os.Getenv("STRIPE_SECRET")
 	user := auth.GetUserFromContext(c)
 	if user.Email == "" {
 		return c.JSON(400, map[string]string{"error": "Invalid user"})
 	}
+	if user.PremiumActive() && user.StripeSubscriptionID != "" {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "You already have a subscription"})
+	}
+	plan := c.QueryParam("plan")
+	if plan == "" {
+		plan = PlanMonthly
+	}
+	price := planPrice(plan)
+	if price == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid plan"})
+	}
 
 	params := &stripe.CheckoutSessionParams{
 		PaymentMethodTypes: stripe.StringSlice([]string{
 			"card",
 		}),
-		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
+		Mode: stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{
+			{Price: stripe.String(price), Quantity: stripe.Int64(1)},
+		},
 		SuccessURL: stripe.String(os.Getenv("STRIPE_SUCCESS_URL")),
 		CancelURL:  stripe.String(os.Getenv("STRIPE_CANCEL_URL")),
-		Customer:   stripe.String(user.Email),
+		// the webhook finds the user by these
+		ClientReferenceID: stripe.String(user.UUID),
+		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+			Metadata: map[string]string{"uuid": user.UUID},
+		},
+	}
+	if user.StripeCustomerID != "" {
+		params.Customer = stripe.String(user.StripeCustomerID)
+	} else {
+		params.CustomerEmail = stripe.String(user.Email)
 	}
 
-	sess, err := session.New(params)
+	sess, err := provider.NewCheckoutSession(params)
 	if err != nil {
 		return c.JSON(500, map[string]string{"error": "Error creating session"})
 	}
 
-	return c.JSON(200, map[string]string{"id": sess.ID})
+	return c.JSON(200, map[string]string{"id": sess.ID, "url": sess.URL})
 }
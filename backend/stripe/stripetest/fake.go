@@ -0,0 +1,418 @@
+// Package stripetest fakes the Stripe API for tests of the stripe package.
+package stripetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stripe/stripe-go/v79"
+	"github.com/stripe/stripe-go/v79/webhook"
+)
+
+// Fake is an in-process stripe.Provider for integration tests. It keeps checkout
+// sessions, customers and subscriptions in memory and makes the webhook
+// events Stripe would send, signed with Secret:
+//
+//	fake := stripetest.NewFake("whsec_test")
+//	stripe.SetProvider(fake)
+//	// start a checkout through the API, then
+//	events, _ := fake.CompleteCheckout(sessionID)
+//	for _, event := range events {
+//		e.ServeHTTP(rec, event.Request())
+//	}
+type Fake struct {
+	Secret   string
+	Amount   int64
+	Currency stripe.Currency
+
+	mu            sync.Mutex
+	run           string
+	next          int
+	sessions      map[string]*stripe.CheckoutSession
+	customers     map[string]*stripe.Customer
+	subscriptions map[string]*stripe.Subscription
+	// payments holds each customer's latest invoice or one-time payment, for Refund
+	payments map[string]*stripe.Charge
+}
+
+// SignedEvent is a webhook event and the Stripe-Signature header it came with.
+type SignedEvent struct {
+	ID      string
+	Type    string
+	Payload []byte
+	Header  string
+}
+
+// NewFake returns a Fake that charges $5.00 a period.
+func NewFake(secret string) *Fake {
+	return &Fake{
+		Secret:        secret,
+		run:           strconv.FormatInt(time.Now().UnixNano(), 36),
+		Amount:        500,
+		Currency:      stripe.CurrencyUSD,
+		sessions:      make(map[string]*stripe.CheckoutSession),
+		customers:     make(map[string]*stripe.Customer),
+		subscriptions: make(map[string]*stripe.Subscription),
+		payments:      make(map[string]*stripe.Charge),
+	}
+}
+
+// Request is the event as Stripe would POST it to the webhook.
+func (e SignedEvent) Request() *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/stripe/webhook", bytes.NewReader(e.Payload))
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	req.Header.Set("Stripe-Signature", e.Header)
+	return req
+}
+
+// Post sends the event to a running server, e.g. http://localhost:8080.
+func (e SignedEvent) Post(baseURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/api/stripe/webhook", bytes.NewReader(e.Payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderContentType, "application/json")
+	req.Header.Set("Stripe-Signature", e.Header)
+	return http.DefaultClient.Do(req)
+}
+
+// newID makes an ID that no other Fake has used, so events from an earlier
+// run aren't taken for ones already handled.
+func (f *Fake) newID(prefix string) string {
+	f.next++
+	return fmt.Sprintf("%s_fake_%s_%d", prefix, f.run, f.next)
+}
+
+func (f *Fake) NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sess := &stripe.CheckoutSession{
+		ID:            f.newID("cs"),
+		Object:        "checkout.session",
+		Status:        stripe.CheckoutSessionStatusOpen,
+		PaymentStatus: stripe.CheckoutSessionPaymentStatusUnpaid,
+		AmountTotal:   f.Amount,
+		Currency:      f.Currency,
+		Created:       time.Now().Unix(),
+		Metadata:      map[string]string{},
+	}
+	sess.URL = "https://checkout.stripe.test/c/pay/" + sess.ID
+	if params.Mode != nil {
+		sess.Mode = stripe.CheckoutSessionMode(*params.Mode)
+	}
+	if params.ClientReferenceID != nil {
+		sess.ClientReferenceID = *params.ClientReferenceID
+	}
+	if params.CustomerEmail != nil {
+		sess.CustomerEmail = *params.CustomerEmail
+	}
+	if params.Customer != nil {
+		customer, ok := f.customers[*params.Customer]
+		if !ok {
+			return nil, fmt.Errorf("no such customer: %s", *params.Customer)
+		}
+		sess.Customer = customer
+	}
+	for k, v := range params.Metadata {
+		sess.Metadata[k] = v
+	}
+	// the price and subscription metadata are kept for CompleteCheckout
+	if len(params.LineItems) > 0 && params.LineItems[0].Price != nil {
+		sess.LineItems = &stripe.LineItemList{Data: []*stripe.LineItem{{Price: &stripe.Price{ID: *params.LineItems[0].Price}}}}
+	}
+	if params.SubscriptionData != nil {
+		sess.Subscription = &stripe.Subscription{Metadata: params.SubscriptionData.Metadata}
+	}
+
+	f.sessions[sess.ID] = sess
+	copied := *sess
+	return &copied, nil
+}
+
+func (f *Fake) GetCheckoutSession(id string) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sess, ok := f.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such checkout session: %s", id)
+	}
+	copied := *sess
+	return &copied, nil
+}
+
+func (f *Fake) GetSubscription(id string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", id)
+	}
+	copied := *sub
+	return &copied, nil
+}
+
+func (f *Fake) UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", id)
+	}
+	if params.CancelAtPeriodEnd != nil {
+		sub.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+	}
+	copied := *sub
+	return &copied, nil
+}
+
+func (f *Fake) CancelSubscription(id string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", id)
+	}
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.EndedAt = time.Now().Unix()
+	copied := *sub
+	return &copied, nil
+}
+
+func (f *Fake) NewPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sess := &stripe.BillingPortalSession{ID: f.newID("bps"), Object: "billing_portal.session"}
+	if params.Customer != nil {
+		sess.Customer = *params.Customer
+	}
+	if params.ReturnURL != nil {
+		sess.ReturnURL = *params.ReturnURL
+	}
+	sess.URL = "https://billing.stripe.test/p/session/" + sess.ID
+	return sess, nil
+}
+
+func (f *Fake) ConstructEvent(payload []byte, header string) (stripe.Event, error) {
+	return webhook.ConstructEventWithOptions(payload, header, f.Secret,
+		webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+}
+
+// event wraps object in a signed event of the given type.
+func (f *Fake) event(eventType string, object interface{}) (SignedEvent, error) {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return SignedEvent{}, err
+	}
+	id := f.newID("evt")
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          id,
+		"object":      "event",
+		"type":        eventType,
+		"api_version": stripe.APIVersion,
+		"created":     time.Now().Unix(),
+		"data":        map[string]json.RawMessage{"object": raw},
+	})
+	if err != nil {
+		return SignedEvent{}, err
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: f.Secret, Timestamp: time.Now()})
+	return SignedEvent{ID: id, Type: eventType, Payload: signed.Payload, Header: signed.Header}, nil
+}
+
+// periodEnd is a month after start, or a year for STRIPE_PRICE_YEARLY.
+func periodEnd(start time.Time, sub *stripe.Subscription) time.Time {
+	if yearly := os.Getenv("STRIPE_PRICE_YEARLY"); yearly != "" && sub.Items != nil {
+		for _, item := range sub.Items.Data {
+			if item.Price != nil && item.Price.ID == yearly {
+				return start.AddDate(1, 0, 0)
+			}
+		}
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// invoice bills sub for its current period.
+func (f *Fake) invoice(sub *stripe.Subscription) *stripe.Invoice {
+	id := f.newID("in")
+	f.payments[sub.Customer.ID] = &stripe.Charge{Invoice: &stripe.Invoice{ID: id}}
+	return &stripe.Invoice{
+		ID:                  id,
+		Object:              "invoice",
+		Customer:            sub.Customer,
+		Subscription:        &stripe.Subscription{ID: sub.ID},
+		SubscriptionDetails: &stripe.InvoiceSubscriptionDetails{Metadata: sub.Metadata},
+		Status:              stripe.InvoiceStatusPaid,
+		Paid:                true,
+		AmountPaid:          f.Amount,
+		Currency:            f.Currency,
+		Created:             time.Now().Unix(),
+		HostedInvoiceURL:    "https://invoice.stripe.test/i/" + id,
+		Lines: &stripe.InvoiceLineItemList{Data: []*stripe.InvoiceLineItem{{
+			Period: &stripe.Period{Start: sub.CurrentPeriodStart, End: sub.CurrentPeriodEnd},
+		}}},
+	}
+}
+
+// CompleteCheckout pays for a checkout session, creating its customer and, in
+// subscription mode, an active subscription. It returns the
+// checkout.session.completed event and the first invoice.paid.
+func (f *Fake) CompleteCheckout(id string) ([]SignedEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sess, ok := f.sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such checkout session: %s", id)
+	}
+	if sess.Status != stripe.CheckoutSessionStatusOpen {
+		return nil, fmt.Errorf("checkout session %s is %s", id, sess.Status)
+	}
+
+	if sess.Customer == nil {
+		customer := &stripe.Customer{ID: f.newID("cus"), Object: "customer", Email: sess.CustomerEmail}
+		f.customers[customer.ID] = customer
+		sess.Customer = customer
+	}
+	sess.CustomerDetails = &stripe.CheckoutSessionCustomerDetails{Email: sess.Customer.Email}
+	sess.Status = stripe.CheckoutSessionStatusComplete
+	sess.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+
+	var events []SignedEvent
+	var inv *stripe.Invoice
+	if sess.Mode == stripe.CheckoutSessionModeSubscription {
+		now := time.Now()
+		sub := &stripe.Subscription{
+			ID:                 f.newID("sub"),
+			Object:             "subscription",
+			Customer:           &stripe.Customer{ID: sess.Customer.ID},
+			Status:             stripe.SubscriptionStatusActive,
+			CurrentPeriodStart: now.Unix(),
+			Items:              &stripe.SubscriptionItemList{},
+		}
+		if sess.Subscription != nil {
+			sub.Metadata = sess.Subscription.Metadata
+		}
+		if sess.LineItems != nil {
+			for _, item := range sess.LineItems.Data {
+				sub.Items.Data = append(sub.Items.Data, &stripe.SubscriptionItem{Price: item.Price, Quantity: 1})
+			}
+		}
+		sub.CurrentPeriodEnd = periodEnd(now, sub).Unix()
+		f.subscriptions[sub.ID] = sub
+		sess.Subscription = &stripe.Subscription{ID: sub.ID}
+		inv = f.invoice(sub)
+	} else {
+		sess.PaymentIntent = &stripe.PaymentIntent{ID: f.newID("pi")}
+		f.payments[sess.Customer.ID] = &stripe.Charge{PaymentIntent: &stripe.PaymentIntent{ID: sess.PaymentIntent.ID}}
+	}
+
+	completed, err := f.event("checkout.session.completed", sess)
+	if err != nil {
+		return nil, err
+	}
+	events = append(events, completed)
+	if inv != nil {
+		paid, err := f.event("invoice.paid", inv)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, paid)
+	}
+	return events, nil
+}
+
+// RenewSubscription starts a subscription's next period and pays for it.
+func (f *Fake) RenewSubscription(id string) ([]SignedEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", id)
+	}
+	sub.CurrentPeriodStart = sub.CurrentPeriodEnd
+	sub.CurrentPeriodEnd = periodEnd(time.Unix(sub.CurrentPeriodStart, 0), sub).Unix()
+	sub.Status = stripe.SubscriptionStatusActive
+
+	paid, err := f.event("invoice.paid", f.invoice(sub))
+	if err != nil {
+		return nil, err
+	}
+	updated, err := f.event("customer.subscription.updated", sub)
+	if err != nil {
+		return nil, err
+	}
+	return []SignedEvent{paid, updated}, nil
+}
+
+// FailRenewal starts a subscription's next period without paying for it, so
+// it goes past due.
+func (f *Fake) FailRenewal(id string) (SignedEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[id]
+	if !ok {
+		return SignedEvent{}, fmt.Errorf("no such subscription: %s", id)
+	}
+	sub.CurrentPeriodStart = sub.CurrentPeriodEnd
+	sub.CurrentPeriodEnd = periodEnd(time.Unix(sub.CurrentPeriodStart, 0), sub).Unix()
+	sub.Status = stripe.SubscriptionStatusPastDue
+	return f.event("customer.subscription.updated", sub)
+}
+
+// SubscriptionUpdated is the customer.subscription.updated event for a
+// subscription as it is now, e.g. after UpdateSubscription.
+func (f *Fake) SubscriptionUpdated(id string) (SignedEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[id]
+	if !ok {
+		return SignedEvent{}, fmt.Errorf("no such subscription: %s", id)
+	}
+	return f.event("customer.subscription.updated", sub)
+}
+
+// EndSubscription cancels a subscription right away.
+func (f *Fake) EndSubscription(id string) (SignedEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[id]
+	if !ok {
+		return SignedEvent{}, fmt.Errorf("no such subscription: %s", id)
+	}
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.EndedAt = time.Now().Unix()
+	return f.event("customer.subscription.deleted", sub)
+}
+
+// Refund fully refunds a customer's latest invoice or one-time payment.
+func (f *Fake) Refund(customerID string) (SignedEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	paid, ok := f.payments[customerID]
+	if !ok {
+		return SignedEvent{}, fmt.Errorf("nothing to refund for customer: %s", customerID)
+	}
+	charge := &stripe.Charge{
+		ID:             f.newID("ch"),
+		Object:         "charge",
+		Customer:       &stripe.Customer{ID: customerID},
+		Invoice:        paid.Invoice,
+		PaymentIntent:  paid.PaymentIntent,
+		Amount:         f.Amount,
+		AmountRefunded: f.Amount,
+		Currency:       f.Currency,
+		Paid:           true,
+		Refunded:       true,
+		Created:        time.Now().Unix(),
+	}
+	return f.event("charge.refunded", charge)
+}
@@ -0,0 +1,165 @@
+package stripetest
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v79"
+)
+
+func subscriptionCheckout(t *testing.T, fake *Fake, price string) *stripe.CheckoutSession {
+	t.Helper()
+	sess, err := fake.NewCheckoutSession(&stripe.CheckoutSessionParams{
+		Mode:          stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems:     []*stripe.CheckoutSessionLineItemParams{{Price: stripe.String(price), Quantity: stripe.Int64(1)}},
+		CustomerEmail: stripe.String("user@example.com"),
+		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+			Metadata: map[string]string{"uuid": "user-uuid"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+// decode checks an event's signature as the webhook would and decodes it.
+func decode(t *testing.T, fake *Fake, event SignedEvent, object interface{}) {
+	t.Helper()
+	parsed, err := fake.ConstructEvent(event.Payload, event.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(parsed.Type) != event.Type || parsed.ID != event.ID {
+		t.Fatalf("event %s %s was sent as %s %s", parsed.Type, parsed.ID, event.Type, event.ID)
+	}
+	if err := json.Unmarshal(parsed.Data.Raw, object); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompleteCheckout(t *testing.T) {
+	fake := NewFake("whsec_test")
+	sess := subscriptionCheckout(t, fake, "price_monthly")
+
+	events, err := fake.CompleteCheckout(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Type != "checkout.session.completed" || events[1].Type != "invoice.paid" {
+		t.Fatalf("got %+v, want checkout.session.completed and invoice.paid", events)
+	}
+
+	var completed stripe.CheckoutSession
+	decode(t, fake, events[0], &completed)
+	if completed.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid || completed.Customer == nil || completed.Subscription == nil {
+		t.Fatalf("completed session %+v", completed)
+	}
+	sub, err := fake.GetSubscription(completed.Subscription.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != stripe.SubscriptionStatusActive || sub.Metadata["uuid"] != "user-uuid" {
+		t.Fatalf("subscription %+v", sub)
+	}
+
+	var invoice stripe.Invoice
+	decode(t, fake, events[1], &invoice)
+	if invoice.Customer.ID != completed.Customer.ID || invoice.Lines.Data[0].Period.End != sub.CurrentPeriodEnd {
+		t.Fatalf("invoice %+v doesn't pay for %+v", invoice, sub)
+	}
+
+	if _, err := fake.CompleteCheckout(sess.ID); err == nil {
+		t.Fatal("completed a checkout twice")
+	}
+}
+
+func TestTamperedEventIsRejected(t *testing.T) {
+	fake := NewFake("whsec_test")
+	events, err := fake.CompleteCheckout(subscriptionCheckout(t, fake, "price_monthly").ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := append([]byte{}, events[0].Payload...)
+	payload[len(payload)-2] = ' '
+	if _, err := fake.ConstructEvent(payload, events[0].Header); err == nil {
+		t.Fatal("accepted a changed payload")
+	}
+	if _, err := NewFake("whsec_other").ConstructEvent(events[0].Payload, events[0].Header); err == nil {
+		t.Fatal("accepted an event signed with another secret")
+	}
+}
+
+func TestYearlyPeriod(t *testing.T) {
+	t.Setenv("STRIPE_PRICE_YEARLY", "price_yearly")
+	fake := NewFake("whsec_test")
+	events, err := fake.CompleteCheckout(subscriptionCheckout(t, fake, "price_yearly").ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var completed stripe.CheckoutSession
+	decode(t, fake, events[0], &completed)
+	sub, err := fake.GetSubscription(completed.Subscription.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(sub.CurrentPeriodStart, 0)
+	if end := time.Unix(sub.CurrentPeriodEnd, 0); !end.Equal(start.AddDate(1, 0, 0)) {
+		t.Fatalf("period %s to %s, want a year", start, end)
+	}
+}
+
+func TestRefundIsForLatestInvoice(t *testing.T) {
+	fake := NewFake("whsec_test")
+	events, err := fake.CompleteCheckout(subscriptionCheckout(t, fake, "price_monthly").ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var completed stripe.CheckoutSession
+	decode(t, fake, events[0], &completed)
+
+	renewal, err := fake.RenewSubscription(completed.Subscription.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var invoice stripe.Invoice
+	decode(t, fake, renewal[0], &invoice)
+
+	refund, err := fake.Refund(completed.Customer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var charge stripe.Charge
+	decode(t, fake, refund, &charge)
+	if !charge.Refunded || charge.Invoice == nil || charge.Invoice.ID != invoice.ID {
+		t.Fatalf("refund %+v, want the renewal invoice %s refunded", charge, invoice.ID)
+	}
+}
+
+func TestPaymentCheckoutRefund(t *testing.T) {
+	fake := NewFake("whsec_test")
+	sess, err := fake.NewCheckoutSession(&stripe.CheckoutSessionParams{Mode: stripe.String(string(stripe.CheckoutSessionModePayment))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := fake.CompleteCheckout(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events for a one-time payment, want 1", len(events))
+	}
+	var completed stripe.CheckoutSession
+	decode(t, fake, events[0], &completed)
+
+	refund, err := fake.Refund(completed.Customer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var charge stripe.Charge
+	decode(t, fake, refund, &charge)
+	if charge.PaymentIntent == nil || completed.PaymentIntent == nil || charge.PaymentIntent.ID != completed.PaymentIntent.ID {
+		t.Fatalf("refund %+v isn't for the checkout's payment", charge)
+	}
+}
@@ -0,0 +1,144 @@
+package stripe
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"github.com/labstack/echo/v4"
+	"github.com/stripe/stripe-go/v79"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	PlanMonthly = "monthly"
+	PlanYearly  = "yearly"
+)
+
+// how long premium is kept while Stripe retries a failed renewal
+var pastDueGrace = 7 * 24 * time.Hour
+
+// planPrice returns the Stripe price ID of a plan, set with
+// STRIPE_PRICE_MONTHLY and STRIPE_PRICE_YEARLY.
+func planPrice(plan string) string {
+	switch plan {
+	case PlanMonthly:
+		return os.Getenv("STRIPE_PRICE_MONTHLY")
+	case PlanYearly:
+		return os.Getenv("STRIPE_PRICE_YEARLY")
+	}
+	return ""
+}
+
+// subscriptionPlan names the plan a subscription is on.
+func subscriptionPlan(sub *stripe.Subscription) string {
+	if sub.Items == nil {
+		return ""
+	}
+	for _, item := range sub.Items.Data {
+		if item.Price == nil {
+			continue
+		}
+		for _, plan := range []string{PlanMonthly, PlanYearly} {
+			if price := planPrice(plan); price != "" && item.Price.ID == price {
+				return plan
+			}
+		}
+	}
+	return ""
+}
+
+// setCancelAtPeriodEnd cancels the logged in user's subscription at the end of
+// the period they paid for, or undoes that. Stripe's
+// customer.subscription.updated event then updates the user.
+func setCancelAtPeriodEnd(c echo.Context, cancel bool) error {
+	user := auth.GetUserFromContext(c)
+	if user.UUID == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if user.StripeSubscriptionID == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "You don't have a subscription"})
+	}
+
+	sub, err := provider.UpdateSubscription(user.StripeSubscriptionID, &stripe.SubscriptionParams{CancelAtPeriodEnd: stripe.Bool(cancel)})
+	if err != nil {
+		log.Println("Error updating subscription:", err)
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "Error updating subscription"})
+	}
+	// the event will say the same, but the page shouldn't wait for it
+	if err := updateUser(c.Request().Context(), user.UUID, bson.M{"cancelatperiodend": sub.CancelAtPeriodEnd}); err != nil {
+		log.Println("Error updating user:", err)
+	}
+
+	if cancel {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Your subscription will end at the end of this period"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Your subscription will renew"})
+}
+
+// CancelSubscription stops the subscription from renewing.
+func CancelSubscription(c echo.Context) error {
+	return setCancelAtPeriodEnd(c, true)
+}
+
+// ResumeSubscription renews a subscription that was set to cancel.
+func ResumeSubscription(c echo.Context) error {
+	return setCancelAtPeriodEnd(c, false)
+}
+
+// EndSubscription cancels the user's subscription right away, e.g. before
+// their account is deleted. One that has already ended is left alone.
+func EndSubscription(user auth.User) error {
+	if user.StripeSubscriptionID == "" {
+		return nil
+	}
+	sub, err := provider.GetSubscription(user.StripeSubscriptionID)
+	if err != nil {
+		return err
+	}
+	if sub.Status == stripe.SubscriptionStatusCanceled || sub.Status == stripe.SubscriptionStatusIncompleteExpired {
+		return nil
+	}
+	_, err = provider.CancelSubscription(user.StripeSubscriptionID)
+	return err
+}
+
+// GetPortalSession opens Stripe's billing portal, where the user can update
+// their card, download receipts and cancel.
+func GetPortalSession(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.UUID == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if user.StripeCustomerID == "" {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "You haven't subscribed yet"})
+	}
+
+	params := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(user.StripeCustomerID),
+		ReturnURL: stripe.String(auth.SiteURL() + "/billing"),
+	}
+	sess, err := provider.NewPortalSession(params)
+	if err != nil {
+		log.Println("Error creating portal session:", err)
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "Error opening the billing portal"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"url": sess.URL})
+}
+
+// ListPayments returns the logged in user's payments and refunds, newest first.
+func ListPayments(c echo.Context) error {
+	user := auth.GetUserFromContext(c)
+	if user.UUID == "" {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	list, err := GetPayments(c.Request().Context(), user.UUID)
+	if err != nil {
+		log.Println("Error listing payments:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+	return c.JSON(http.StatusOK, list)
+}
@@ -0,0 +1,437 @@
+package stripe
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/logs"
+	"github.com/labstack/echo/v4"
+	"github.com/stripe/stripe-go/v79"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stripe's events are well under this
+var maxWebhookBody int64 = 1 << 20
+
+// Kinds of Payment.
+const (
+	PaymentCheckout = "checkout"
+	PaymentInvoice  = "invoice"
+	PaymentRefund   = "refund"
+)
+
+// Payment is a charge or refund we have been told about by Stripe.
+type Payment struct {
+	UUID     string    `bson:"uuid" json:"-"`
+	StripeID string    `bson:"stripe_id" json:"stripe_id"`
+	Kind     string    `bson:"kind" json:"kind"`
+	Amount   int64     `bson:"amount" json:"amount"`
+	Currency string    `bson:"currency" json:"currency"`
+	URL      string    `bson:"url,omitempty" json:"url,omitempty"`
+	Date     time.Time `bson:"date" json:"date"`
+	// PaymentIntent matches a checkout's refund back to it.
+	PaymentIntent string `bson:"payment_intent,omitempty" json:"-"`
+}
+
+func events() *mongo.Collection {
+	return database.DB_Main.Collection("stripe_events")
+}
+
+func payments() *mongo.Collection {
+	return database.DB_Main.Collection("payments")
+}
+
+// checkouts lists the checkout sessions that have given premium, by ID.
+func checkouts() *mongo.Collection {
+	return database.DB_Main.Collection("stripe_checkouts")
+}
+
+// Webhook receives events from Stripe. Each event is handled once: its ID is
+// recorded before handling and forgotten again if handling fails, so Stripe's
+// retry gets another go.
+func Webhook(c echo.Context) error {
+	payload, err := io.ReadAll(io.LimitReader(c.Request().Body, maxWebhookBody))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Error reading request"})
+	}
+	event, err := provider.ConstructEvent(payload, c.Request().Header.Get("Stripe-Signature"))
+	if err != nil {
+		logs.Error("Invalid Stripe webhook:", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid signature"})
+	}
+	ctx := c.Request().Context()
+
+	_, err = events().InsertOne(ctx, bson.M{"_id": event.ID, "type": event.Type, "received_at": time.Now()})
+	if mongo.IsDuplicateKeyError(err) {
+		return c.JSON(http.StatusOK, map[string]string{"message": "Event already handled"})
+	}
+	if err != nil {
+		logs.Error("Error recording Stripe event:", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	if err := handleEvent(ctx, event); err != nil {
+		logs.Error("Error handling Stripe event", event.ID, event.Type, err)
+		if _, err := events().DeleteOne(ctx, bson.M{"_id": event.ID}); err != nil {
+			logs.Error("Error forgetting Stripe event:", err)
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Event handled"})
+}
+
+func handleEvent(ctx context.Context, event stripe.Event) error {
+	switch event.Type {
+	case "checkout.session.completed":
+		var sess stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &sess); err != nil {
+			return err
+		}
+		return fulfillCheckout(ctx, &sess)
+	case "invoice.paid":
+		var invoice stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &invoice); err != nil {
+			return err
+		}
+		return invoicePaid(ctx, &invoice)
+	case "customer.subscription.updated", "customer.subscription.deleted":
+		var sub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+			return err
+		}
+		return subscriptionChanged(ctx, &sub, event.Type == "customer.subscription.deleted")
+	case "charge.refunded":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return err
+		}
+		return chargeRefunded(ctx, &charge)
+	}
+	return nil
+}
+
+// GetUserByStripeCustomer returns the user a Stripe customer belongs to.
+func GetUserByStripeCustomer(customerID string) (auth.User, error) {
+	var entry auth.UserList
+	err := database.DB_UserList.Collection("users").FindOne(context.Background(), bson.M{"stripecustomerid": customerID}).Decode(&entry)
+	if err != nil {
+		return auth.User{}, err
+	}
+	return auth.GetUserByUUID(entry.UUID)
+}
+
+// customerUser finds who an event is for: by Stripe customer, or by the UUID
+// our subscriptions carry in their metadata when the event beats
+// checkout.session.completed here. Events for customers we don't know, e.g.
+// ones made by hand in the Stripe dashboard, are skipped rather than retried.
+func customerUser(ctx context.Context, customer *stripe.Customer, metadata map[string]string) (auth.User, bool, error) {
+	if customer == nil || customer.ID == "" {
+		return auth.User{}, false, nil
+	}
+	user, err := GetUserByStripeCustomer(customer.ID)
+	if err == mongo.ErrNoDocuments && metadata["uuid"] != "" {
+		user, err = auth.GetUserByUUID(metadata["uuid"])
+		if err == nil {
+			err = setStripeCustomer(ctx, user.UUID, customer.ID)
+		}
+	}
+	if err == mongo.ErrNoDocuments {
+		logs.Info("Stripe event for unknown customer", customer.ID)
+		return auth.User{}, false, nil
+	}
+	if err != nil {
+		return auth.User{}, false, err
+	}
+	return user, true, nil
+}
+
+func updateUser(ctx context.Context, uuid string, set bson.M) error {
+	_, err := database.DB_Users.Collection(uuid).UpdateOne(ctx, bson.M{"uuid": uuid}, bson.M{"$set": set})
+	return err
+}
+
+// setStripeCustomer remembers which Stripe customer a user is, both on the user
+// and in DB_UserList so events can be matched to them.
+func setStripeCustomer(ctx context.Context, uuid string, customerID string) error {
+	if err := updateUser(ctx, uuid, bson.M{"stripecustomerid": customerID}); err != nil {
+		return err
+	}
+	_, err := database.DB_UserList.Collection("users").UpdateOne(ctx, bson.M{"uuid": uuid}, bson.M{"$set": bson.M{"stripecustomerid": customerID}})
+	return err
+}
+
+func recordPayment(ctx context.Context, payment Payment) error {
+	filter := bson.M{"stripe_id": payment.StripeID, "kind": payment.Kind}
+	_, err := payments().ReplaceOne(ctx, filter, payment, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetPayments returns a user's payments, newest first.
+func GetPayments(ctx context.Context, uuid string) ([]Payment, error) {
+	cursor, err := payments().Find(ctx, bson.M{"uuid": uuid}, options.Find().SetSort(bson.M{"date": -1}))
+	if err != nil {
+		return nil, err
+	}
+	list := []Payment{}
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// laterExpiry returns whichever of the current expiry and t is later, so
+// premium is never shortened by an event arriving out of order.
+func laterExpiry(current string, t time.Time) string {
+	if expiry, err := time.Parse(time.RFC3339, current); err == nil && expiry.After(t) {
+		return current
+	}
+	return t.Format(time.RFC3339)
+}
+
+// checkoutUser finds who a checkout was for. Sessions we create carry the UUID;
+// the email is a fallback for older ones.
+func checkoutUser(sess *stripe.CheckoutSession) (auth.User, error) {
+	if sess.ClientReferenceID != "" {
+		return auth.GetUserByUUID(sess.ClientReferenceID)
+	}
+	if sess.CustomerDetails != nil && sess.CustomerDetails.Email != "" {
+		return auth.GetUserByEmail(sess.CustomerDetails.Email)
+	}
+	return auth.GetUserByEmail(sess.CustomerEmail)
+}
+
+// fulfillCheckout gives premium for a completed checkout session. It is called
+// by both the webhook and the success page; a session is only ever applied
+// once, and a subscription only while Stripe says it is running.
+func fulfillCheckout(ctx context.Context, sess *stripe.CheckoutSession) error {
+	if sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid &&
+		sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusNoPaymentRequired {
+		return nil
+	}
+	user, err := checkoutUser(sess)
+	if err == mongo.ErrNoDocuments {
+		logs.Info("Checkout", sess.ID, "for unknown user")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	subscribed := sess.Subscription != nil && sess.Subscription.ID != ""
+	if subscribed {
+		sub, err := provider.GetSubscription(sess.Subscription.ID)
+		if err != nil {
+			return err
+		}
+		if sub.Status != stripe.SubscriptionStatusActive && sub.Status != stripe.SubscriptionStatusTrialing {
+			logs.Info("Checkout", sess.ID, "is for subscription", sub.ID, "which is", sub.Status)
+			return nil
+		}
+	}
+
+	_, err = checkouts().InsertOne(ctx, bson.M{"_id": sess.ID, "uuid": user.UUID, "fulfilled_at": time.Now()})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := applyCheckout(ctx, user, sess, subscribed); err != nil {
+		// forgotten again so the webhook's retry can apply it
+		if _, err := checkouts().DeleteOne(ctx, bson.M{"_id": sess.ID}); err != nil {
+			logs.Error("Error forgetting checkout:", err)
+		}
+		return err
+	}
+	logs.Info("Premium activated for", user.Username, "by checkout", sess.ID)
+	return nil
+}
+
+func applyCheckout(ctx context.Context, user auth.User, sess *stripe.CheckoutSession, subscribed bool) error {
+	set := bson.M{"premium": true, "transactionid": sess.ID}
+	if subscribed {
+		// invoice.paid brings the end of the billing period; until then premium runs for a day
+		set["stripesubscriptionid"] = sess.Subscription.ID
+		set["subscriptionstatus"] = string(stripe.SubscriptionStatusActive)
+		set["cancelatperiodend"] = false
+		set["premiumexpiry"] = laterExpiry(user.PremiumExpiry, time.Now().Add(24*time.Hour))
+	} else {
+		set["premiumexpiry"] = laterExpiry(user.PremiumExpiry, time.Now().AddDate(0, 1, 0))
+	}
+	if err := updateUser(ctx, user.UUID, set); err != nil {
+		return err
+	}
+	if sess.Customer != nil && sess.Customer.ID != "" {
+		if err := setStripeCustomer(ctx, user.UUID, sess.Customer.ID); err != nil {
+			return err
+		}
+	}
+
+	// a subscription's payments are recorded from its invoices
+	if subscribed {
+		return nil
+	}
+	payment := Payment{
+		UUID:     user.UUID,
+		StripeID: sess.ID,
+		Kind:     PaymentCheckout,
+		Amount:   sess.AmountTotal,
+		Currency: string(sess.Currency),
+		Date:     time.Now(),
+	}
+	if sess.PaymentIntent != nil {
+		payment.PaymentIntent = sess.PaymentIntent.ID
+	}
+	return recordPayment(ctx, payment)
+}
+
+// invoicePaid extends premium to the end of the period the invoice paid for.
+func invoicePaid(ctx context.Context, invoice *stripe.Invoice) error {
+	var metadata map[string]string
+	if invoice.SubscriptionDetails != nil {
+		metadata = invoice.SubscriptionDetails.Metadata
+	}
+	user, ok, err := customerUser(ctx, invoice.Customer, metadata)
+	if !ok {
+		return err
+	}
+
+	var periodEnd int64
+	if invoice.Lines != nil {
+		for _, line := range invoice.Lines.Data {
+			if line.Period != nil && line.Period.End > periodEnd {
+				periodEnd = line.Period.End
+			}
+		}
+	}
+	if periodEnd > 0 {
+		set := bson.M{"premium": true, "premiumexpiry": laterExpiry(user.PremiumExpiry, time.Unix(periodEnd, 0))}
+		if err := updateUser(ctx, user.UUID, set); err != nil {
+			return err
+		}
+	}
+
+	return recordPayment(ctx, Payment{
+		UUID:     user.UUID,
+		StripeID: invoice.ID,
+		Kind:     PaymentInvoice,
+		Amount:   invoice.AmountPaid,
+		Currency: string(invoice.Currency),
+		URL:      invoice.HostedInvoiceURL,
+		Date:     time.Unix(invoice.Created, 0),
+	})
+}
+
+// subscriptionChanged keeps premium in step with the customer's subscription.
+// A subscription set to cancel at period end stays active until Stripe deletes
+// it; a past due one keeps premium for pastDueGrace while Stripe retries.
+func subscriptionChanged(ctx context.Context, sub *stripe.Subscription, deleted bool) error {
+	user, ok, err := customerUser(ctx, sub.Customer, sub.Metadata)
+	if !ok {
+		return err
+	}
+	// an old subscription mustn't overwrite or end the one that replaced it
+	if user.StripeSubscriptionID != "" && user.StripeSubscriptionID != sub.ID {
+		return nil
+	}
+	ended := deleted || sub.Status == stripe.SubscriptionStatusCanceled || sub.Status == stripe.SubscriptionStatusUnpaid ||
+		sub.Status == stripe.SubscriptionStatusIncompleteExpired
+
+	set := bson.M{
+		"stripesubscriptionid": sub.ID,
+		"subscriptionstatus":   string(sub.Status),
+		"subscriptionplan":     subscriptionPlan(sub),
+		"cancelatperiodend":    sub.CancelAtPeriodEnd,
+	}
+	switch {
+	case ended:
+		set["premium"] = false
+		set["stripesubscriptionid"] = ""
+		set["subscriptionstatus"] = string(stripe.SubscriptionStatusCanceled)
+		set["cancelatperiodend"] = false
+		logs.Info("Premium ended for", user.Username, "subscription", sub.ID, sub.Status)
+	case sub.Status == stripe.SubscriptionStatusActive, sub.Status == stripe.SubscriptionStatusTrialing:
+		set["premium"] = true
+		set["premiumexpiry"] = laterExpiry(user.PremiumExpiry, time.Unix(sub.CurrentPeriodEnd, 0))
+	case sub.Status == stripe.SubscriptionStatusPastDue:
+		// counted from the start of the unpaid period, so retries don't stretch it
+		set["premium"] = true
+		set["premiumexpiry"] = laterExpiry(user.PremiumExpiry, time.Unix(sub.CurrentPeriodStart, 0).Add(pastDueGrace))
+		logs.Info("Subscription", sub.ID, "of", user.Username, "is past due")
+	}
+	return updateUser(ctx, user.UUID, set)
+}
+
+// chargeRefunded records a refund. A full refund of what is paying for premium
+// right now ends it: a subscription is cancelled, and customer.subscription.deleted
+// then takes premium away, while a one-time checkout's premium is taken here.
+// Refunds of earlier periods leave premium alone.
+func chargeRefunded(ctx context.Context, charge *stripe.Charge) error {
+	user, ok, err := customerUser(ctx, charge.Customer, nil)
+	if !ok {
+		return err
+	}
+
+	if charge.Refunded {
+		if err := refundPremium(ctx, user, charge); err != nil {
+			return err
+		}
+	}
+
+	return recordPayment(ctx, Payment{
+		UUID:     user.UUID,
+		StripeID: charge.ID,
+		Kind:     PaymentRefund,
+		Amount:   charge.AmountRefunded,
+		Currency: string(charge.Currency),
+		Date:     time.Now(),
+	})
+}
+
+func refundPremium(ctx context.Context, user auth.User, charge *stripe.Charge) error {
+	if charge.Invoice != nil && charge.Invoice.ID != "" {
+		if user.StripeSubscriptionID == "" {
+			return nil
+		}
+		var latest Payment
+		opts := options.FindOne().SetSort(bson.D{{Key: "date", Value: -1}})
+		err := payments().FindOne(ctx, bson.M{"uuid": user.UUID, "kind": PaymentInvoice}, opts).Decode(&latest)
+		if err == mongo.ErrNoDocuments || (err == nil && latest.StripeID != charge.Invoice.ID) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := provider.CancelSubscription(user.StripeSubscriptionID); err != nil {
+			return err
+		}
+		logs.Info("Subscription of", user.Username, "cancelled after refund of", charge.ID)
+		return nil
+	}
+
+	if charge.PaymentIntent == nil || charge.PaymentIntent.ID == "" || user.StripeSubscriptionID != "" {
+		return nil
+	}
+	var paid Payment
+	filter := bson.M{"uuid": user.UUID, "kind": PaymentCheckout, "payment_intent": charge.PaymentIntent.ID}
+	err := payments().FindOne(ctx, filter).Decode(&paid)
+	if err == mongo.ErrNoDocuments || (err == nil && paid.StripeID != user.TransactionID) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := updateUser(ctx, user.UUID, bson.M{"premium": false, "premiumexpiry": ""}); err != nil {
+		return err
+	}
+	logs.Info("Premium revoked from", user.Username, "after refund of", charge.ID)
+	return nil
+}
@@ -0,0 +1,347 @@
+// The purchase flows write to the MongoDB in MONGO_URI, so point it at a
+// scratch database to run them:
+//
+//	MONGO_URI=mongodb://localhost:27017 go test ./backend/stripe/
+//
+// Without MONGO_URI they are skipped; the rest needs no database or network.
+package stripe_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"blogr.moe/backend/auth"
+	"blogr.moe/backend/database"
+	"blogr.moe/backend/stripe"
+	"blogr.moe/backend/stripe/stripetest"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	stripeapi "github.com/stripe/stripe-go/v79"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestMain fails rather than skips when MONGO_URI is set but the database
+// can't be reached, so a broken setup doesn't look like a pass.
+func TestMain(m *testing.M) {
+	if database.DB_Main != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := database.DB_Main.Client().Ping(ctx, nil)
+		cancel()
+		if err != nil {
+			fmt.Println("MONGO_URI is set but MongoDB isn't reachable:", err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+func needMongo(t *testing.T) {
+	t.Helper()
+	if database.DB_Main == nil {
+		t.Skip("MONGO_URI is not set")
+	}
+}
+
+// newFake makes a Fake the handlers use until the test ends.
+func newFake(t *testing.T) *stripetest.Fake {
+	t.Helper()
+	t.Setenv("STRIPE_PRICE_MONTHLY", "price_monthly_test")
+	fake := stripetest.NewFake("whsec_test")
+	previous := stripe.SetProvider(fake)
+	t.Cleanup(func() { stripe.SetProvider(previous) })
+	return fake
+}
+
+// newUser adds a user for the test and removes them and their payments after.
+func newUser(t *testing.T) auth.User {
+	t.Helper()
+	ctx := context.Background()
+	id := uuid.New().String()
+	user := auth.User{
+		UUID:        id,
+		Email:       id + "@example.com",
+		Username:    "stripetest-" + id[:8],
+		DateCreated: time.Now().Format("2006-01-02 15:04:05"),
+		GroupID:     1,
+		Theme:       "light",
+	}
+	if _, err := database.DB_Users.Collection(id).InsertOne(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	list := map[string]string{"username": user.Username, "uuid": id, "email": user.Email}
+	if _, err := database.DB_UserList.Collection("users").InsertOne(ctx, list); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := auth.DeleteUser(ctx, id); err != nil {
+			t.Error(err)
+		}
+		for _, name := range []string{"payments", "stripe_checkouts"} {
+			if _, err := database.DB_Main.Collection(name).DeleteMany(ctx, bson.M{"uuid": id}); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	return user
+}
+
+func reload(t *testing.T, user auth.User) auth.User {
+	t.Helper()
+	user, err := auth.GetUserByUUID(user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func expiry(t *testing.T, user auth.User) time.Time {
+	t.Helper()
+	expiry, err := time.Parse(time.RFC3339, user.PremiumExpiry)
+	if err != nil {
+		t.Fatalf("premiumexpiry %q: %v", user.PremiumExpiry, err)
+	}
+	return expiry
+}
+
+// serve sends the events to the webhook, as Stripe would.
+func serve(t *testing.T, events ...stripetest.SignedEvent) {
+	t.Helper()
+	e := echo.New()
+	for _, event := range events {
+		rec := httptest.NewRecorder()
+		if err := stripe.Webhook(e.NewContext(event.Request(), rec)); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s", event.Type, rec.Code, rec.Body.String())
+		}
+	}
+	t.Cleanup(func() {
+		for _, event := range events {
+			database.DB_Main.Collection("stripe_events").DeleteOne(context.Background(), bson.M{"_id": event.ID})
+		}
+	})
+}
+
+// checkout buys the monthly plan for user through the API and returns the
+// events Stripe sends for it, without serving them.
+func checkout(t *testing.T, fake *stripetest.Fake, user auth.User) []stripetest.SignedEvent {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/stripe/checkout?plan=monthly", nil), rec)
+	c.Set("user", user)
+	if err := stripe.GetCheckoutSession(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("checkout: got %d %s", rec.Code, rec.Body.String())
+	}
+	var sess map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &sess); err != nil {
+		t.Fatal(err)
+	}
+	events, err := fake.CompleteCheckout(sess["id"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+// subscribe buys the monthly plan for user and returns them with premium.
+func subscribe(t *testing.T, fake *stripetest.Fake, user auth.User) auth.User {
+	t.Helper()
+	serve(t, checkout(t, fake, user)...)
+	return reload(t, user)
+}
+
+func TestWebhookRejectsBadSignature(t *testing.T) {
+	fake := newFake(t)
+	other := stripetest.NewFake("whsec_other")
+	sess, err := other.NewCheckoutSession(&stripeapi.CheckoutSessionParams{Mode: stripeapi.String("payment")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := other.CompleteCheckout(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := stripe.Webhook(echo.New().NewContext(events[0].Request(), rec)); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got %d, want %d for an event signed with another secret than %q", rec.Code, http.StatusBadRequest, fake.Secret)
+	}
+}
+
+func TestCheckoutGivesPremium(t *testing.T) {
+	needMongo(t)
+	fake := newFake(t)
+	user := subscribe(t, fake, newUser(t))
+
+	if !user.Premium || user.StripeSubscriptionID == "" {
+		t.Fatalf("premium %v, subscription %q", user.Premium, user.StripeSubscriptionID)
+	}
+	if expires := expiry(t, user); expires.Before(time.Now().AddDate(0, 1, -1)) {
+		t.Fatalf("premium expires %s, want a month from now", expires)
+	}
+
+	payments, err := stripe.GetPayments(context.Background(), user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].Kind != stripe.PaymentInvoice || payments[0].Amount != fake.Amount {
+		t.Fatalf("payments %+v, want one invoice of %d", payments, fake.Amount)
+	}
+}
+
+func TestEventsAreHandledOnce(t *testing.T) {
+	needMongo(t)
+	fake := newFake(t)
+	user := newUser(t)
+	events := checkout(t, fake, user)
+	serve(t, events...)
+	first := reload(t, user)
+
+	// Stripe sends events again when it didn't see our answer
+	serve(t, events...)
+	again := reload(t, user)
+	if again.PremiumExpiry != first.PremiumExpiry {
+		t.Fatalf("premium expiry moved from %s to %s", first.PremiumExpiry, again.PremiumExpiry)
+	}
+	payments, err := stripe.GetPayments(context.Background(), user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 {
+		t.Fatalf("got %d payments, want 1", len(payments))
+	}
+}
+
+func TestRenewalExtendsPremium(t *testing.T) {
+	needMongo(t)
+	fake := newFake(t)
+	user := subscribe(t, fake, newUser(t))
+	before := expiry(t, user)
+
+	events, err := fake.RenewSubscription(user.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, events...)
+
+	user = reload(t, user)
+	if after := expiry(t, user); !after.After(before.AddDate(0, 0, 27)) {
+		t.Fatalf("premium expires %s after renewal, was %s", after, before)
+	}
+}
+
+func TestPastDueKeepsPremiumForGrace(t *testing.T) {
+	needMongo(t)
+	fake := newFake(t)
+	user := subscribe(t, fake, newUser(t))
+
+	event, err := fake.FailRenewal(user.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, event)
+
+	user = reload(t, user)
+	sub, err := fake.GetSubscription(user.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Unix(sub.CurrentPeriodStart, 0).Add(7 * 24 * time.Hour)
+	if !user.Premium || user.SubscriptionStatus != string(stripeapi.SubscriptionStatusPastDue) || !expiry(t, user).Equal(want) {
+		t.Fatalf("premium %v, status %q, expiry %s; want premium past due until %s", user.Premium, user.SubscriptionStatus, user.PremiumExpiry, want)
+	}
+}
+
+func TestCancelAtPeriodEnd(t *testing.T) {
+	needMongo(t)
+	fake := newFake(t)
+	user := subscribe(t, fake, newUser(t))
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/api/stripe/cancel", nil), rec)
+	c.Set("user", user)
+	if err := stripe.CancelSubscription(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("cancel: got %d %s", rec.Code, rec.Body.String())
+	}
+	updated, err := fake.SubscriptionUpdated(user.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, updated)
+
+	user = reload(t, user)
+	if !user.CancelAtPeriodEnd || !user.PremiumActive() {
+		t.Fatalf("cancel at period end %v, premium %v; want premium until the period ends", user.CancelAtPeriodEnd, user.PremiumActive())
+	}
+
+	deleted, err := fake.EndSubscription(user.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, deleted)
+
+	user = reload(t, user)
+	if user.Premium || user.StripeSubscriptionID != "" {
+		t.Fatalf("premium %v, subscription %q after the period ended", user.Premium, user.StripeSubscriptionID)
+	}
+}
+
+func TestRefundEndsPremium(t *testing.T) {
+	needMongo(t)
+	fake := newFake(t)
+	user := subscribe(t, fake, newUser(t))
+
+	refunded, err := fake.Refund(user.StripeCustomerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, refunded)
+
+	// the refund cancels the subscription; Stripe then says it has ended
+	sub, err := fake.GetSubscription(user.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Status != stripeapi.SubscriptionStatusCanceled {
+		t.Fatalf("subscription is %s after a refund, want canceled", sub.Status)
+	}
+	deleted, err := fake.EndSubscription(sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, deleted)
+
+	user = reload(t, user)
+	if user.Premium {
+		t.Fatal("premium kept after a refund")
+	}
+	payments, err := stripe.GetPayments(context.Background(), user.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refunds := 0
+	for _, payment := range payments {
+		if payment.Kind == stripe.PaymentRefund {
+			refunds++
+		}
+	}
+	if refunds != 1 {
+		t.Fatalf("payments %+v, want one refund", payments)
+	}
+}
@@ -2,15 +2,51 @@ package cache
 
 // dragonflydb / redis client
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
 )
 
+// ErrNotFound is returned by Get when a key doesn't exist or has expired.
+var ErrNotFound = errors.New("key not found")
+
+// Store is the key/value interface shared by the redis client and the
+// in-memory fallback used when REDIS_ADDR isn't configured.
+type Store interface {
+	Set(key string, value string, expiration time.Duration) error
+	Get(key string) (string, error)
+	SetNX(key string, value string, expiration time.Duration) (bool, error)
+	Incr(key string, expiration time.Duration) (int64, error)
+	Delete(key string) error
+	SAdd(key string, member string, expiration time.Duration) error
+	SRem(key string, member string) error
+	SMembers(key string) ([]string, error)
+}
+
+var (
+	defaultStore Store
+	defaultOnce  sync.Once
+)
+
+// Default returns a redis backed store when REDIS_ADDR is set and an
+// in-memory store otherwise. The same store is returned on every call.
+func Default() Store {
+	defaultOnce.Do(func() {
+		if os.Getenv("REDIS_ADDR") != "" {
+			defaultStore = NewRedisClient()
+		} else {
+			defaultStore = NewMemoryStore()
+		}
+	})
+	return defaultStore
+}
+
 // RedisClient is a struct that holds the redis client
 type RedisClient struct {
 	client *redis.Client
@@ -43,12 +79,75 @@ func (r *RedisClient) Set(key string, value string, expiration time.Duration) er
 // Get gets a value from redis
 func (r *RedisClient) Get(key string) (string, error) {
 	val, err := r.client.Get(key).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to get key: %v", err)
 	}
 	return val, nil
 }
 
+// SetNX sets a key only if it doesn't exist yet and reports whether it was set
+func (r *RedisClient) SetNX(key string, value string, expiration time.Duration) (bool, error) {
+	ok, err := r.client.SetNX(key, value, expiration).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to set key: %v", err)
+	}
+	return ok, nil
+}
+
+// Incr increments a counter; the expiration is applied when the counter is created
+func (r *RedisClient) Incr(key string, expiration time.Duration) (int64, error) {
+	n, err := r.client.Incr(key).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment key: %v", err)
+	}
+	if n == 1 && expiration > 0 {
+		r.client.Expire(key, expiration)
+	}
+	return n, nil
+}
+
+// Delete removes a key from redis
+func (r *RedisClient) Delete(key string) error {
+	err := r.client.Del(key).Err()
+	if err != nil {
+		return fmt.Errorf("failed to delete key: %v", err)
+	}
+	return nil
+}
+
+// SAdd adds a member to a set and (re)sets the set's expiration
+func (r *RedisClient) SAdd(key string, member string, expiration time.Duration) error {
+	err := r.client.SAdd(key, member).Err()
+	if err != nil {
+		return fmt.Errorf("failed to add member: %v", err)
+	}
+	if expiration > 0 {
+		r.client.Expire(key, expiration)
+	}
+	return nil
+}
+
+// SRem removes a member from a set
+func (r *RedisClient) SRem(key string, member string) error {
+	err := r.client.SRem(key, member).Err()
+	if err != nil {
+		return fmt.Errorf("failed to remove member: %v", err)
+	}
+	return nil
+}
+
+// SMembers returns the members of a set, or none if it doesn't exist
+func (r *RedisClient) SMembers(key string) ([]string, error) {
+	members, err := r.client.SMembers(key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get members: %v", err)
+	}
+	return members, nil
+}
+
 // Close closes the redis client
 func (r *RedisClient) Close() {
 	err := r.client.Close()
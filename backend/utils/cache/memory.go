@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryItem struct {
+	value   string
+	members map[string]struct{}
+	expires time.Time
+}
+
+// MemoryStore is an in-process Store for deployments without redis.
+// Values are lost on restart and are not shared between instances.
+type MemoryStore struct {
+	mu    sync.Mutex
+	items map[string]memoryItem
+}
+
+// NewMemoryStore creates an empty MemoryStore and starts its janitor
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{items: make(map[string]memoryItem)}
+	go m.janitor(time.Minute)
+	return m
+}
+
+func expiry(expiration time.Duration) time.Time {
+	if expiration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(expiration)
+}
+
+// get returns a live item; the caller must hold the lock
+func (m *MemoryStore) get(key string) (memoryItem, bool) {
+	item, ok := m.items[key]
+	if !ok {
+		return memoryItem{}, false
+	}
+	if !item.expires.IsZero() && time.Now().After(item.expires) {
+		delete(m.items, key)
+		return memoryItem{}, false
+	}
+	return item, true
+}
+
+// Set sets a key value pair
+func (m *MemoryStore) Set(key string, value string, expiration time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[key] = memoryItem{value: value, expires: expiry(expiration)}
+	return nil
+}
+
+// Get gets a value
+func (m *MemoryStore) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.get(key)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return item.value, nil
+}
+
+// SetNX sets a key only if it doesn't exist yet and reports whether it was set
+func (m *MemoryStore) SetNX(key string, value string, expiration time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.get(key); ok {
+		return false, nil
+	}
+	m.items[key] = memoryItem{value: value, expires: expiry(expiration)}
+	return true, nil
+}
+
+// Incr increments a counter; the expiration is applied when the counter is created
+func (m *MemoryStore) Incr(key string, expiration time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.get(key)
+	if !ok {
+		item = memoryItem{value: "0", expires: expiry(expiration)}
+	}
+	n, err := strconv.ParseInt(item.value, 10, 64)
+	if err != nil {
+		n = 0
+	}
+	n++
+	item.value = strconv.FormatInt(n, 10)
+	m.items[key] = item
+	return n, nil
+}
+
+// Delete removes a key
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, key)
+	return nil
+}
+
+// SAdd adds a member to a set and (re)sets the set's expiration
+func (m *MemoryStore) SAdd(key string, member string, expiration time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.get(key)
+	if !ok || item.members == nil {
+		item = memoryItem{members: make(map[string]struct{})}
+	}
+	item.members[member] = struct{}{}
+	item.expires = expiry(expiration)
+	m.items[key] = item
+	return nil
+}
+
+// SRem removes a member from a set
+func (m *MemoryStore) SRem(key string, member string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if item, ok := m.get(key); ok && item.members != nil {
+		delete(item.members, member)
+	}
+	return nil
+}
+
+// SMembers returns the members of a set, or none if it doesn't exist
+func (m *MemoryStore) SMembers(key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.get(key)
+	if !ok {
+		return nil, nil
+	}
+	members := make([]string, 0, len(item.members))
+	for member := range item.members {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// janitor drops expired items so the map doesn't grow forever
+func (m *MemoryStore) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		now := time.Now()
+		for key, item := range m.items {
+			if !item.expires.IsZero() && now.After(item.expires) {
+				delete(m.items, key)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
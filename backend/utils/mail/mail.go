@@ -71,6 +71,11 @@ func TestMail() {
 	}
 }
 
+// QueueStats reports the backlog of the mail queue.
+func QueueStats() []queue.QueueStats {
+	return manager.Stats()
+}
+
 func AddMailToQueue(to, subject, body string) {
 	q.Enqueue(func() {
 		SendEmail(to, subject, body)
@@ -69,6 +69,11 @@ func (q *Queue) Size() int {
 	return len(q.queue)
 }
 
+// Cap returns how many functions the queue can hold.
+func (q *Queue) Cap() int {
+	return cap(q.queue)
+}
+
 // Process starts processing the queue in a separate goroutine.
 func (q *Queue) Process() {
 	q.wg.Add(1)
@@ -125,6 +130,24 @@ func (qm *QueueManager) GetQueue(name string, bufferSize int) *Queue {
 	return q
 }
 
+// QueueStats is a snapshot of one queue's backlog.
+type QueueStats struct {
+	Name     string `json:"name"`
+	Size     int    `json:"size"`
+	Capacity int    `json:"capacity"`
+}
+
+// Stats returns the backlog of every queue managed by the QueueManager.
+func (qm *QueueManager) Stats() []QueueStats {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	stats := []QueueStats{}
+	for name, q := range qm.queues {
+		stats = append(stats, QueueStats{Name: name, Size: q.Size(), Capacity: q.Cap()})
+	}
+	return stats
+}
+
 // StopAll stops all queues managed by the QueueManager.
 func (qm *QueueManager) StopAll() {
 	qm.mu.Lock()
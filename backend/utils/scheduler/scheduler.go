@@ -2,47 +2,95 @@ package scheduler
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
 type Task struct {
+	Name     string
 	Action   func()
 	Duration time.Duration
 }
 
+// TaskStatus describes how a scheduled task has been running.
+type TaskStatus struct {
+	Name         string        `json:"name"`
+	Interval     time.Duration `json:"interval"`
+	Runs         int           `json:"runs"`
+	LastRun      time.Time     `json:"last_run"`
+	LastDuration time.Duration `json:"last_duration"`
+}
+
 type Scheduler struct {
 	StartTime          time.Time
 	LastUpdate         time.Time
 	LastUpdateDuration time.Duration
 	Tasks              []Task
+
+	mu       sync.Mutex
+	statuses []*TaskStatus
 }
 
+// every scheduler is registered so Status can report on all of them
+var (
+	registryMu sync.Mutex
+	registry   []*Scheduler
+)
+
 func NewScheduler() *Scheduler {
-	return &Scheduler{
+	s := &Scheduler{
 		StartTime: time.Now(),
 		Tasks:     []Task{},
 	}
+	registryMu.Lock()
+	registry = append(registry, s)
+	registryMu.Unlock()
+	return s
 }
 
 func (s *Scheduler) ScheduleTask(task Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Tasks = append(s.Tasks, task)
+	s.statuses = append(s.statuses, &TaskStatus{Name: task.Name, Interval: task.Duration})
 }
 
 func (s *Scheduler) Run() {
 	s.StartTime = time.Now()
 	fmt.Println("Schedule started at: ", s.StartTime)
 
-	for _, task := range s.Tasks {
-		go func(t Task) {
+	for i, task := range s.Tasks {
+		go func(t Task, status *TaskStatus) {
 			ticker := time.NewTicker(t.Duration)
 			defer ticker.Stop()
 
 			for range ticker.C {
+				started := time.Now()
 				t.Action()
+				s.mu.Lock()
 				s.LastUpdate = time.Now()
 				s.LastUpdateDuration = s.LastUpdate.Sub(s.StartTime)
+				status.Runs++
+				status.LastRun = started
+				status.LastDuration = s.LastUpdate.Sub(started)
+				s.mu.Unlock()
 				fmt.Println("Task executed at: ", s.LastUpdate)
 			}
-		}(task)
+		}(task, s.statuses[i])
+	}
+}
+
+// Status returns a snapshot of every task of every scheduler.
+func Status() []TaskStatus {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	statuses := []TaskStatus{}
+	for _, s := range registry {
+		s.mu.Lock()
+		for _, status := range s.statuses {
+			statuses = append(statuses, *status)
+		}
+		s.mu.Unlock()
 	}
+	return statuses
 }
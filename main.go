@@ -7,14 +7,15 @@ import (
 	"strconv"
 	"time"
 
+	"blogr.moe/backend/account"
 	"blogr.moe/backend/auth"
+	"blogr.moe/backend/blog"
 	"blogr.moe/backend/database"
 	"blogr.moe/backend/routes"
+	"blogr.moe/backend/search"
 	"blogr.moe/backend/utils/scheduler"
 	"github.com/joho/godotenv"
 
-	"github.com/gorilla/sessions"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
@@ -30,16 +31,13 @@ func main() {
 	if secret == "" {
 		log.Fatal("SECRET is not set")
 	}
-	store := sessions.NewCookieStore([]byte(secret))
-	store.Options = &sessions.Options{
-		Domain:   baseUrl,
-		Path:     "/",
-		MaxAge:   86400,
-		HttpOnly: false,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
+	if database.DB_Main == nil {
+		log.Fatal("MongoDB is not configured, check MONGO_URI")
+	}
+	// without it anyone could sign a Stripe event
+	if os.Getenv("STRIPE_WEBHOOK_SECRET") == "" {
+		log.Fatal("STRIPE_WEBHOOK_SECRET is not set")
 	}
-
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "${id} ${time_rfc3339} ${remote_ip} > ${method} > ${uri} > ${status} ${latency_human}\n",
 	}))
@@ -53,6 +51,11 @@ func main() {
 		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "X-CSRF-Token", "Authorization", "X-CSRF-Token"},
 	}))
 	e.Use(middleware.CSRFWithConfig(middleware.CSRFConfig{
+		// API tokens aren't sent by browsers on their own, so they can't be forged cross-site.
+		// Stripe's webhook is signed instead.
+		Skipper: func(c echo.Context) bool {
+			return auth.BearerToken(c) != "" || c.Path() == "/api/stripe/webhook"
+		},
 		TokenLookup:    "cookie:csrf",
 		CookieDomain:   baseUrl,
 		CookieName:     "csrf",
@@ -76,18 +79,57 @@ func main() {
 		Output: accesslog, // Set the Output to the log file
 	}))
 	routes.RegisterRoutes(e)
-	c := e.NewContext(nil, nil)
+
+	if err := blog.BackfillTags(); err != nil {
+		log.Println("Error backfilling tags:", err)
+	}
+	search.Init()
 
 	s24h := scheduler.NewScheduler()
 	s24h.ScheduleTask(scheduler.Task{
-		Action: func() {
-			auth.IsPaymentActive(c)
-		},
+		Name:     "expire-premium",
+		Action:   auth.ExpirePremium,
 		Duration: 24 * time.Hour,
 	})
 	go s24h.Run()
+
+	s1m := scheduler.NewScheduler()
+	s1m.ScheduleTask(scheduler.Task{
+		Name: "publish-scheduled",
+		Action: func() {
+			if err := blog.PublishScheduledPosts(); err != nil {
+				log.Println("Error publishing scheduled posts:", err)
+			}
+		},
+		Duration: time.Minute,
+	})
+	s1m.ScheduleTask(scheduler.Task{
+		Name:     "flush-views",
+		Action:   blog.FlushViews,
+		Duration: time.Minute,
+	})
+	go s1m.Run()
+
+	s5m := scheduler.NewScheduler()
+	s5m.ScheduleTask(scheduler.Task{
+		Name:     "search-refresh",
+		Action:   search.Refresh,
+		Duration: 5 * time.Minute,
+	})
+	s5m.ScheduleTask(scheduler.Task{
+		Name:     "account-deletions",
+		Action:   account.ProcessDeletions,
+		Duration: 5 * time.Minute,
+	})
+	s5m.ScheduleTask(scheduler.Task{
+		Name:     "expire-exports",
+		Action:   account.ExpireExports,
+		Duration: 5 * time.Minute,
+	})
+	go s5m.Run()
 	database.GetTotalPostCount()
 	database.GetTotalUserCount()
+	database.GetTotalCommentCount()
 
 	portStr := os.Getenv("PORT")
 	port, err := strconv.Atoi(portStr)
@@ -97,7 +139,6 @@ func main() {
 	//backups.BackupFiles()
 	//mail.TestMail()
 	//queue.NewQueueManager().ProcessAll()
-	e.Use(session.Middleware(store))
 
 	e.StartTLS(":"+strconv.Itoa(port), "backend/certificates/cert.pem", "backend/certificates/key.pem")
 }